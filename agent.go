@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pickAgent         = "PickAgent"
+	agentUnsupported  = "AgentUnsupported"
+	authFailureStatus = 0x01
+)
+
+// AgentAcl is an --agentallow entry, user:name with * for any user or
+// name.
+type AgentAcl struct {
+	User  string
+	Agent string
+}
+
+func ParseAgentAcls(specs []string) ([]*AgentAcl, error) {
+	var acls []*AgentAcl
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("agent allow %s is not user:name", spec)
+		}
+		acls = append(acls, &AgentAcl{User: spec[:i], Agent: spec[i+1:]})
+	}
+	return acls, nil
+}
+
+// agentAllowed tells whether user may register as the agent name, nobody
+// may without --agentallow.
+func agentAllowed(acls []*AgentAcl, user string, name string) bool {
+	for _, acl := range acls {
+		if (acl.User == "*" || acl.User == user) && (acl.Agent == "*" || acl.Agent == name) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewAgents(acls []*AgentAcl) *Agents {
+	return &Agents{acls: acls, sessions: make(map[string]*WsSocks5Proxy)}
+}
+
+// Agents are the sessions of the clients registered by name.
+type Agents struct {
+	sync.Mutex
+	acls     []*AgentAcl
+	sessions map[string]*WsSocks5Proxy
+}
+
+func (a *Agents) get(name string) *WsSocks5Proxy {
+	a.Lock()
+	defer a.Unlock()
+	return a.sessions[name]
+}
+
+// register serves an AGENT request of the session w, the agent is known
+// as long as the tunnel of the request and the session.
+func (a *Agents) register(w *WsSocks5Proxy, req *Request, logger *log.Entry) (net.Conn, error) {
+	name := req.Host()
+	if !agentAllowed(a.acls, w.user, name) {
+		logger.Warnf("server - agent %s not allowed", name)
+		return nil, errRejected
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	// the last one of the same user wins, the session of a reconnecting
+	// agent may not be known down yet
+	if known := a.sessions[name]; known != nil {
+		if known.user != w.user {
+			logger.Warnf("server - agent %s already registered by user %s", name, known.user)
+			return nil, errRejected
+		}
+		logger.Warnf("server - agent %s replaced", name)
+	}
+	a.sessions[name] = w
+	logger.Infof("server - agent %s connected", name)
+
+	return w.control(func() {
+		a.Lock()
+		defer a.Unlock()
+		if a.sessions[name] == w {
+			delete(a.sessions, name)
+			logger.Infof("server - agent %s disconnected", name)
+		}
+	}), nil
+}
+
+// ParseAgentListener parses addr[=agent], the agent is chosen by the socks
+// username on listeners without one.
+func ParseAgentListener(spec string) (*AgentListener, error) {
+	addr, agent, _ := strings.Cut(spec, "=")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("agent listener %s: %v", spec, err)
+	}
+	return &AgentListener{Addr: addr, Agent: agent}, nil
+}
+
+// AgentListener is a socks5 listener of the server whose connections are
+// dialed from the network of an agent.
+type AgentListener struct {
+	Addr     string
+	Agent    string
+	Password string
+	agents   *Agents
+	listener net.Listener
+}
+
+func (l *AgentListener) Serve(agents *Agents) error {
+	var err error
+	l.agents = agents
+	l.listener, err = net.Listen("tcp", l.Addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("server - agent socks listener on %s", l.Addr)
+
+	go func() {
+		for {
+			conn, err := l.listener.Accept()
+			if err != nil {
+				log.Errorf("server agent listener %s stopped: %v", l.Addr, err)
+				return
+			}
+			go l.accept(conn)
+		}
+	}()
+	return nil
+}
+
+func (l *AgentListener) accept(c net.Conn) {
+	conn := NewBufferedConn(c)
+	tunnel, err := l.handshake(conn)
+	if err != nil {
+		log.Error(err)
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		conn.Close()
+		return
+	}
+	NewProxyConnection(tunnel, conn).TunnelTraffic()
+}
+
+// handshake is a socks5 handshake asking username and password when the
+// agent is not fixed or a password is set.
+func (l *AgentListener) handshake(c *BufferedConn) (s io.ReadWriteCloser, err error) {
+	var phase = initPhase
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "[agent handshake] error on phase: %s", phase)
+		}
+	}()
+
+	methodRequest, err := ReadMethodRequest(c.Reader())
+	if err != nil {
+		phase = readMethodRequest
+		return
+	}
+
+	method := NOAUTH
+	if len(l.Agent) == 0 || len(l.Password) > 0 {
+		method = UPASSW
+	}
+	reply := &MethodReply{Socks5Version, NOACPT}
+	for _, m := range methodRequest.Methods {
+		if m == method {
+			reply.Method = method
+		}
+	}
+	_, err = c.Write(reply.Encode())
+	if err != nil {
+		phase = writeMethodReply
+		return
+	}
+	if reply.Method == NOACPT {
+		phase = writeMethodReply
+		err = fmt.Errorf("client offers no method %d", method)
+		return
+	}
+
+	name := l.Agent
+	if method == UPASSW {
+		var username, password string
+		username, password, err = readUserPassword(c)
+		if err != nil {
+			phase = readUserPasswd
+			return
+		}
+		status := []byte{upasswVersion, upasswSuccess}
+		if len(l.Password) > 0 && subtle.ConstantTimeCompare([]byte(password), []byte(l.Password)) != 1 {
+			status[1] = authFailureStatus
+		}
+		_, err = c.Write(status)
+		if err != nil {
+			phase = writeAuthStatus
+			return
+		}
+		if status[1] != upasswSuccess {
+			phase = writeAuthStatus
+			err = fmt.Errorf("password of %s rejected", username)
+			return
+		}
+		if len(name) == 0 {
+			name = username
+		}
+	}
+
+	req, err := ReadRequest(c.Reader())
+	if err != nil {
+		phase = readSocks5Request
+		SendSocks5Reply(c, REFUSED, nil)
+		return
+	}
+	if req.CmdOrRep != CONNECT && req.CmdOrRep != UDP {
+		phase = agentUnsupported
+		err = fmt.Errorf("command %d not supported", req.CmdOrRep)
+		SendSocks5Reply(c, CMDNSUPP, nil)
+		return
+	}
+
+	agent := l.agents.get(name)
+	if agent == nil {
+		phase = pickAgent
+		err = fmt.Errorf("agent %s not connected", name)
+		SendSocks5Reply(c, GENERAL, nil)
+		return
+	}
+	log.Debugf("server - agent %s tunnel to %s", name, req.Address())
+
+	newConn := func(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+		return agent.OpenTunnel(ctx)
+	}
+	s, tunnelReply, err := TunnelHandshake(agent.ctx, req, newConn)
+	if err != nil {
+		phase = tunnelHandshake
+		SendSocks5Reply(c, tunnelReplyCode(err), nil)
+		return
+	}
+
+	_, err = c.Write(tunnelReply.Encode())
+	if err != nil {
+		phase = writeSocks5Reply
+		return
+	}
+	if tunnelReply.CmdOrRep != SUCCEEDED {
+		phase = failureSocks5Reply
+		err = fmt.Errorf("socks5 Reply with error: %v", tunnelReply.CmdOrRep)
+	}
+	return
+}
+
+// ServeAgent registers the client as agent name on a newly connected
+// session d and dials the tunnels of the server from here.
+func ServeAgent(d Dispatcher, name string, dialer *TargetDialer) {
+	ctx, cancel := sessionContext(d)
+	defer cancel()
+
+	req, err := NewRequest(AGENT, net.JoinHostPort(name, "0"))
+	if err != nil {
+		log.Errorf("client - agent %s: %v", name, err)
+		return
+	}
+	newConn := func(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+		return d.OpenTunnel(ctx)
+	}
+	// the tunnel is kept open, the agent is known as long as it is
+	_, reply, err := TunnelHandshake(ctx, req, newConn)
+	if err != nil {
+		log.Errorf("client - agent %s register error: %v", name, err)
+		return
+	}
+	if reply.CmdOrRep != SUCCEEDED {
+		log.Errorf("client - agent %s refused by server with error: %v", name, reply.CmdOrRep)
+		return
+	}
+	log.Warnf("client - agent %s registered", name)
+
+	dial := func(ctx context.Context, network string, req *Request) (net.Conn, error) {
+		if req.CmdOrRep != CONNECT && req.CmdOrRep != UDP {
+			return nil, errRejected
+		}
+		return dialer.Dial(ctx, network, req, "", log.WithField("agent", name))
+	}
+	ServeServerTunnels(ctx, d, dial)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+func NewTTLCache[V any](size int) *TTLCache[V] {
+	return &TTLCache[V]{
+		size:    size,
+		entries: make(map[string]ttlEntry[V]),
+	}
+}
+
+type ttlEntry[V any] struct {
+	value  V
+	expire time.Time
+}
+
+// TTLCache is a bounded map whose entries expire, a full cache drops expired
+// entries first then arbitrary ones.
+type TTLCache[V any] struct {
+	sync.Mutex
+	size    int
+	entries map[string]ttlEntry[V]
+}
+
+func (c *TTLCache[V]) Get(key string) (v V, ttl time.Duration, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	ttl = time.Until(e.expire)
+	if ttl <= 0 {
+		delete(c.entries, key)
+		return v, 0, false
+	}
+	return e.value, ttl, true
+}
+
+func (c *TTLCache[V]) Set(key string, v V, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[key] = ttlEntry[V]{value: v, expire: time.Now().Add(ttl)}
+}
+
+func (c *TTLCache[V]) evict() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expire) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		delete(c.entries, k)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResolveChains points the servers with a via option to their relay among
+// endpoints, a chain must end at a server reached directly. Relays only take
+// sessions of their own with the exit option.
+func ResolveChains(endpoints []*ServerEndpoint) error {
+	for _, s := range endpoints {
+		if len(s.Via) == 0 {
+			continue
+		}
+		for _, relay := range endpoints {
+			if relay.Name == s.Via && relay != s {
+				s.via = relay
+				relay.relay = true
+				break
+			}
+		}
+		if s.via == nil {
+			return fmt.Errorf("server %s: via unknown server %s", s.Name, s.Via)
+		}
+		if u, err := url.Parse(s.Url); err == nil && u.Scheme == "ws" {
+			log.Warnf("client - server %s is chained without tls, %s sees its traffic", s.Name, s.Via)
+		}
+	}
+
+	for _, s := range endpoints {
+		hops := 0
+		for relay := s.via; relay != nil; relay = relay.via {
+			hops++
+			if hops > len(endpoints) {
+				return fmt.Errorf("server %s: via loops back", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// dialVia connects addr, the next server of a chain, through a tunnel of a
+// session of its own to relay. The websocket of that server runs end to end
+// inside it, the relay only learns its address.
+func (c *ClientProxy) dialVia(ctx context.Context, relay *ServerEndpoint, addr string) (net.Conn, error) {
+	d, err := c.wsDispatcher(ctx, relay, false)
+	if err != nil {
+		return nil, fmt.Errorf("relay %s: %v", relay.Name, err)
+	}
+	connect := func(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+		return d.OpenTunnel(ctx)
+	}
+	tunnel, err := dialTunnel(ctx, addr, connect)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("relay %s: %v", relay.Name, err)
+	}
+
+	conn, remote := net.Pipe()
+	NewProxyConnection(&relayTunnel{ReadWriteCloser: tunnel, relay: d}, remote).TunnelTraffic()
+	return conn, nil
+}
+
+// relayTunnel closes the session to the relay with its only tunnel.
+type relayTunnel struct {
+	io.ReadWriteCloser
+	relay Dispatcher
+}
+
+func (t *relayTunnel) Close() error {
+	err := t.ReadWriteCloser.Close()
+	t.relay.Close()
+	return err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// fake answers are cheap to renew and should not outlive the mapping
+	fakeIPTtl = 60
+
+	defaultTunnelDns = "1.1.1.1:53"
+	tunnelDnsIdle    = 4
+)
+
+type DialTunnel = func(ctx context.Context, address string) (io.ReadWriteCloser, error)
+
+func NewClientDns(fake *FakeIPPool, direct *Resolver, dial DialTunnel, servers []*ServerEndpoint) *ClientDns {
+	d := &ClientDns{
+		fake:      fake,
+		direct:    direct,
+		dial:      dial,
+		cache:     NewTTLCache[[]byte](args.DnsCacheSize),
+		exclude:   normalizeSuffixes(args.FakeIPExclude),
+		zones:     normalizeSuffixes(args.DnsDirect),
+		upstreams: args.TunnelDns,
+		idle:      make(map[string]chan io.ReadWriteCloser),
+	}
+
+	for _, server := range servers {
+		if u, err := url.Parse(server.Url); err == nil && len(u.Hostname()) > 0 && net.ParseIP(u.Hostname()) == nil {
+			// the servers themselves have to be resolved outside of the tunnel
+			d.zones = append(d.zones, strings.ToLower(u.Hostname()))
+		}
+	}
+	if len(d.upstreams) == 0 {
+		d.upstreams = []string{defaultTunnelDns}
+	}
+	for _, upstream := range d.upstreams {
+		d.idle[upstream] = make(chan io.ReadWriteCloser, tunnelDnsIdle)
+	}
+	return d
+}
+
+// ClientDns is the DNS server of the client. A and AAAA queries get fake
+// addresses when enabled, the others are sent over tcp through the tunnel
+// except for the direct zones, answers are cached by their TTL.
+type ClientDns struct {
+	fake      *FakeIPPool
+	direct    *Resolver
+	dial      DialTunnel
+	cache     *TTLCache[[]byte]
+	exclude   []string
+	zones     []string
+	upstreams []string
+	idle      map[string]chan io.ReadWriteCloser
+}
+
+func normalizeSuffixes(suffixes []string) []string {
+	var out []string
+	for _, suffix := range suffixes {
+		out = append(out, strings.ToLower(strings.Trim(suffix, ".")))
+	}
+	return out
+}
+
+func matchDomainSuffix(domain string, suffixes []string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, suffix := range suffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *ClientDns) Handle(ctx context.Context, query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	err := msg.Unpack(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Questions) != 1 {
+		return NewDnsReply(&msg, dnsmessage.RCodeFormatError).Pack()
+	}
+	q := msg.Questions[0]
+	domain := q.Name.String()
+
+	isAddress := q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA
+	if d.fake != nil && isAddress && !matchDomainSuffix(domain, d.exclude) {
+		return d.fakeReply(&msg)
+	}
+
+	key := strings.ToLower(domain) + " " + q.Type.String() + " " + q.Class.String()
+	if resp, _, ok := d.cache.Get(key); ok {
+		resp = append([]byte(nil), resp...)
+		copy(resp, query[:2])
+		return resp, nil
+	}
+
+	var resp []byte
+	if matchDomainSuffix(domain, d.zones) {
+		resp, err = d.exchangeDirect(ctx, &msg, query)
+	} else {
+		resp, err = d.exchangeTunnel(ctx, query)
+	}
+	if err != nil {
+		log.Debugf("client dns - %s %s failure: %v", q.Type, domain, err)
+		return NewDnsReply(&msg, dnsmessage.RCodeServerFailure).Pack()
+	}
+
+	answer, err := ParseDnsAnswer(resp, dnsNegativeTtl)
+	if err == nil && (answer.RCode == dnsmessage.RCodeSuccess || answer.RCode == dnsmessage.RCodeNameError) {
+		d.cache.Set(key, resp, answer.Ttl)
+	}
+	return resp, nil
+}
+
+func (d *ClientDns) fakeReply(msg *dnsmessage.Message) ([]byte, error) {
+	q := msg.Questions[0]
+	reply := NewDnsReply(msg, dnsmessage.RCodeSuccess)
+	ip, ok := d.fake.Lookup(q.Name.String(), q.Type == dnsmessage.TypeAAAA)
+	if ok {
+		log.Debugf("client dns - %s %s faked as %s", q.Type, q.Name, ip)
+		reply.Answers = append(reply.Answers, NewAddressResource(q.Name, ip.AsSlice(), fakeIPTtl))
+	}
+	return reply.Pack()
+}
+
+// exchangeDirect asks the local upstreams, the host resolver only answers
+// address queries.
+func (d *ClientDns) exchangeDirect(ctx context.Context, msg *dnsmessage.Message, query []byte) ([]byte, error) {
+	resp, ok, err := d.direct.Exchange(ctx, query)
+	if ok {
+		return resp, err
+	}
+
+	q := msg.Questions[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return NewDnsReply(msg, dnsmessage.RCodeNotImplemented).Pack()
+	}
+
+	answer, err := d.direct.querySystem(ctx, strings.TrimSuffix(q.Name.String(), "."), q.Type)
+	if err != nil {
+		return nil, err
+	}
+	reply := NewDnsReply(msg, answer.RCode)
+	for _, ip := range answer.IPs {
+		reply.Answers = append(reply.Answers, NewAddressResource(q.Name, ip, uint32(answer.Ttl.Seconds())))
+	}
+	return reply.Pack()
+}
+
+func (d *ClientDns) exchangeTunnel(ctx context.Context, query []byte) ([]byte, error) {
+	var err error
+	for _, upstream := range d.upstreams {
+		var resp []byte
+		resp, err = d.exchangeTunnelUpstream(ctx, upstream, query)
+		if err == nil {
+			return resp, nil
+		}
+		log.Debugf("client dns - tunnel upstream %s failure: %v", upstream, err)
+	}
+	return nil, err
+}
+
+// exchangeTunnelUpstream reuses an idle tunnel to upstream first, servers
+// close idle connections so a failure there is retried on a new one.
+func (d *ClientDns) exchangeTunnelUpstream(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	idle := d.idle[upstream]
+	select {
+	case conn := <-idle:
+		resp, err := exchangeStreamContext(ctx, conn, query)
+		if err == nil {
+			d.release(idle, conn)
+			return resp, nil
+		}
+		conn.Close()
+	default:
+	}
+
+	conn, err := d.dialIdle(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeStreamContext(ctx, conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.release(idle, conn)
+	return resp, nil
+}
+
+// dialIdle opens a tunnel to upstream outliving ctx so it may be idle in
+// the pool, ctx only bounds the handshake.
+func (d *ClientDns) dialIdle(ctx context.Context, upstream string) (io.ReadWriteCloser, error) {
+	type dialed struct {
+		conn io.ReadWriteCloser
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := d.dial(context.Background(), upstream)
+		done <- dialed{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (d *ClientDns) release(idle chan io.ReadWriteCloser, conn io.ReadWriteCloser) {
+	select {
+	case idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func exchangeStreamContext(ctx context.Context, conn io.ReadWriteCloser, query []byte) ([]byte, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	resp, err := ExchangeStream(conn, query)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+func NewBufferedConn(rwc io.ReadWriteCloser) *BufferedConn {
+	return &BufferedConn{
+		ReadWriteCloser: rwc,
+		r:               bufio.NewReader(rwc),
+	}
+}
+
+// BufferedConn lets handshakes peek at the stream, reads keep going through
+// the buffer so nothing peeked is lost for the data phase.
+type BufferedConn struct {
+	io.ReadWriteCloser
+	r *bufio.Reader
+}
+
+func (c *BufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *BufferedConn) Reader() *bufio.Reader {
+	return c.r
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
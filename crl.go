@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func LoadCRL(path string, issuers []*x509.Certificate) (*CRL, error) {
+	c := &CRL{
+		path:    path,
+		issuers: issuers,
+	}
+	return c, c.load()
+}
+
+// CRL holds the revoked serials of a PEM or DER CRL file, the file is read
+// again once modified.
+type CRL struct {
+	sync.Mutex
+	path    string
+	issuers []*x509.Certificate
+	modTime time.Time
+	revoked map[string]bool
+}
+
+func (c *CRL) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return fmt.Errorf("crl %s: %v", c.path, err)
+	}
+	signed := false
+	for _, issuer := range c.issuers {
+		if list.CheckSignatureFrom(issuer) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("crl %s is not signed by a client ca", c.path)
+	}
+
+	revoked := make(map[string]bool)
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	c.modTime = info.ModTime()
+	c.revoked = revoked
+	log.Infof("server - crl %s loaded, %d certificates revoked", c.path, len(revoked))
+	return nil
+}
+
+// Revoked tells whether cert is in the list, a list failing to reload is
+// kept as it was.
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if info, err := os.Stat(c.path); err == nil && !info.ModTime().Equal(c.modTime) {
+		if err = c.load(); err != nil {
+			// wait for the next change rather than failing every handshake
+			c.modTime = info.ModTime()
+			log.Errorf("server - crl reload failure: %v", err)
+		}
+	}
+	return c.revoked[cert.SerialNumber.String()]
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func NewTargetDialer(r *Resolver) *TargetDialer {
+	return &TargetDialer{
+		resolver:     r,
+		timeout:      args.DialTimeout,
+		attemptDelay: args.DialAttemptDelay,
+		maxAddresses: args.DialMaxAddrs,
+		keepAlive:    args.DialKeepAlive,
+	}
+}
+
+// TargetDialer connects the server to the targets, racing the resolved
+// addresses as Happy Eyeballs (RFC 8305) does.
+type TargetDialer struct {
+	resolver     *Resolver
+	timeout      time.Duration
+	attemptDelay time.Duration
+	maxAddresses int
+	keepAlive    time.Duration
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+func (d *TargetDialer) Dial(ctx context.Context, network string, req *Request, user string, logger *log.Entry) (net.Conn, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	ips, err := d.resolver.LookupHost(ctx, req.Host(), user)
+	if err != nil {
+		return nil, err
+	}
+
+	ips = interleaveFamilies(ips)
+	if d.maxAddresses > 0 && len(ips) > d.maxAddresses {
+		ips = ips[:d.maxAddresses]
+	}
+	addrs := make([]string, len(ips))
+	port := strconv.Itoa(int(req.Port))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+
+	if network != "tcp" {
+		// nothing to race without a handshake
+		addrs = addrs[:1]
+	}
+	return d.race(ctx, network, addrs, logger)
+}
+
+// interleaveFamilies alternates the families starting with the first one,
+// keeping the order inside each family.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// race starts an attempt every attemptDelay, or as soon as the previous one
+// failed, the first connection wins and the others are dropped.
+func (d *TargetDialer) race(ctx context.Context, network string, addrs []string, logger *log.Entry) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		dialer   = &net.Dialer{KeepAlive: d.keepAlive}
+		results  = make(chan dialResult, len(addrs))
+		timer    = time.NewTimer(d.attemptDelay)
+		next     int
+		pending  int
+		firstErr error
+	)
+	defer timer.Stop()
+
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		logger.Debugf("dial attempt %d/%d to %s://%s", next, len(addrs), network, addr)
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- dialResult{conn, addr, err}
+		}()
+		// go 1.22 timers keep a stale fire in the channel across Reset
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.attemptDelay)
+	}
+
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				logger.Debugf("dial %s://%s success", network, r.addr)
+				go closeLateDials(results, pending)
+				return r.conn, nil
+			}
+
+			logger.Debugf("dial %s://%s failure: %v", network, r.addr, r.err)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no address to dial")
+	}
+	return nil, firstErr
+}
+
+func closeLateDials(results chan dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -10,13 +10,31 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func NewProxyDispatcher(t Transport) Dispatcher {
+// the high bit of a tunnel id tells the server opened it, each side opens
+// tunnels in its own half and accepts the ones of the other
+const serverTunnelBit uint16 = 0x8000
+
+// NewProxyDispatcher is the dispatcher of the client side of a session, the
+// tunnels of the server are only accepted with accept, by the reverse and
+// agent sessions.
+func NewProxyDispatcher(t Transport, accept bool) Dispatcher {
+	return newProxyDispatcher(t, 0, accept)
+}
+
+// NewServerDispatcher is the dispatcher of the server side of a session.
+func NewServerDispatcher(t Transport) Dispatcher {
+	return newProxyDispatcher(t, serverTunnelBit, true)
+}
+
+func newProxyDispatcher(t Transport, idBase uint16, accept bool) Dispatcher {
 	d := &ProxyDispatcher{
 		Transport: t,
 		RWMutex:   new(sync.RWMutex),
 		tunnels:   make(map[uint16]*tunnel),
 		acceptCh:  make(chan *tunnel, 64),
 		closed:    &atomic.Bool{},
+		idBase:    idBase,
+		accept:    accept,
 	}
 
 	d.ctx, d.cancel = context.WithCancel(context.Background())
@@ -30,6 +48,8 @@ type ProxyDispatcher struct {
 	tunnels  map[uint16]*tunnel
 	acceptCh chan *tunnel
 	index    uint16
+	idBase   uint16
+	accept   bool
 	closed   *atomic.Bool
 	ctx      context.Context
 	cancel   context.CancelFunc
@@ -51,22 +71,39 @@ func (d *ProxyDispatcher) run() {
 				log.Warnf("tunnel %d closed, get the late EOF", f.Id)
 				continue
 			}
+			if f.Id&serverTunnelBit == d.idBase {
+				log.Warnf("tunnel %d closed, get the late frame", f.Id)
+				continue
+			}
 
-			r, err := ParseMethodRequest(f.Data)
+			// the method request may come along with the pipelined request
+			n, err := methodRequestSize(f.Data)
 			if err != nil {
 				log.Errorf("websocket accept tunnel %d, failure with parse MethodRequest: %v", f.Id, err)
 				continue
 			}
 
-			if len(f.Data) != 2+len(r.Methods) {
+			if len(f.Data) < n {
 				log.Errorf("accept frame %d not socks5 method request", f.Id)
 				continue
 			}
 
-			log.Debugf("dispatch accept %d tunnel success", f.Id)
+			// refused tunnels get a FIN, run never waits for an accept
 			t = newTunnel(context.TODO(), f.Id, d)
+			if !d.accept {
+				log.Warnf("dispatch refuse tunnel %d, the session accepts no tunnels", f.Id)
+				t.Close()
+				continue
+			}
 			d.addTunnel(t)
-			d.acceptCh <- t
+			select {
+			case d.acceptCh <- t:
+			default:
+				log.Warnf("dispatch refuse tunnel %d, too many tunnels waiting for accept", f.Id)
+				t.Close()
+				continue
+			}
+			log.Debugf("dispatch accept %d tunnel success", f.Id)
 		}
 		t.readCh <- f
 	}
@@ -76,12 +113,22 @@ func (d *ProxyDispatcher) IsAlive() bool {
 	return !d.closed.Load()
 }
 
+func (d *ProxyDispatcher) Done() <-chan struct{} {
+	return d.ctx.Done()
+}
+
+func (d *ProxyDispatcher) TunnelCount() int {
+	d.RLock()
+	defer d.RUnlock()
+	return len(d.tunnels)
+}
+
 func (d *ProxyDispatcher) OpenTunnel(ctx context.Context) (Tunnel, error) {
 	d.Lock()
 	defer d.Unlock()
 
-	for count := 0; count < 65534; count++ {
-		id := d.index
+	for count := uint16(0); count < serverTunnelBit; count++ {
+		id := d.idBase | d.index&^serverTunnelBit
 		if d.tunnels[id] == nil {
 			t := newTunnel(ctx, id, d)
 			d.tunnels[id] = t
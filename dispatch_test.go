@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// openServerTunnels sends the method requests of count tunnels the server
+// opens to d over peer, and returns the ids answered with a FIN.
+func openServerTunnels(t *testing.T, peer Transport, count int) []uint16 {
+	fins := make(chan uint16, count)
+	go func() {
+		for {
+			f, err := peer.Read()
+			if err != nil {
+				close(fins)
+				return
+			}
+			if f.Len == 0 {
+				fins <- f.Id
+			}
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		f := &Frame{Id: serverTunnelBit | uint16(i), Len: uint16(len(methodNoAuth)), Data: methodNoAuth}
+		if err := peer.Write(f); err != nil {
+			t.Fatalf("tunnel %d: write: %v", i, err)
+		}
+	}
+
+	var refused []uint16
+	for {
+		select {
+		case id, ok := <-fins:
+			if !ok {
+				return refused
+			}
+			refused = append(refused, id)
+		case <-time.After(200 * time.Millisecond):
+			return refused
+		}
+	}
+}
+
+func newDispatcherPair(t *testing.T, accept bool) (Dispatcher, Transport) {
+	local, remote := net.Pipe()
+	d := NewProxyDispatcher(NewTransport(local), accept)
+	peer := NewTransport(remote)
+	// the session closes once its run sees the peer gone
+	t.Cleanup(func() {
+		peer.Close()
+		<-d.Done()
+	})
+	return d, peer
+}
+
+func TestDispatcherRefusesTunnels(t *testing.T) {
+	d, peer := newDispatcherPair(t, false)
+
+	refused := openServerTunnels(t, peer, 3)
+	if len(refused) != 3 {
+		t.Fatalf("%d tunnels refused of 3", len(refused))
+	}
+	if n := d.TunnelCount(); n != 0 {
+		t.Fatalf("%d tunnels kept", n)
+	}
+}
+
+func TestDispatcherAcceptQueueFull(t *testing.T) {
+	d, peer := newDispatcherPair(t, true)
+
+	// nobody accepts, the tunnels past the queue are refused
+	refused := openServerTunnels(t, peer, 66)
+	if len(refused) != 2 {
+		t.Fatalf("%d tunnels refused of 66, the queue takes 64", len(refused))
+	}
+	if !d.IsAlive() {
+		t.Fatal("session closed")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsMessageMax = 65535
+
+// DnsUpstream is a DNS server reached over udp, tcp or https (DoH).
+type DnsUpstream struct {
+	Network string
+	Address string
+}
+
+// ParseDnsUpstream accepts host[:port], udp://host[:port], tcp://host[:port]
+// and https:// DoH urls.
+func ParseDnsUpstream(s string) (*DnsUpstream, error) {
+	if strings.HasPrefix(s, "https://") {
+		return &DnsUpstream{Network: "https", Address: s}, nil
+	}
+
+	network := "udp"
+	if i := strings.Index(s, "://"); i >= 0 {
+		network = strings.ToLower(s[:i])
+		s = s[i+3:]
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("dns upstream network %s not supported", network)
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+	return &DnsUpstream{Network: network, Address: s}, nil
+}
+
+func (u *DnsUpstream) String() string {
+	if u.Network == "https" {
+		return u.Address
+	}
+	return u.Network + "://" + u.Address
+}
+
+func (u *DnsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch u.Network {
+	case "https":
+		return exchangeHTTPS(ctx, u.Address, query)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, u.Network, u.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if u.Network == "tcp" {
+		return ExchangeStream(conn, query)
+	}
+	return exchangePacket(conn, query)
+}
+
+func exchangePacket(conn net.Conn, query []byte) ([]byte, error) {
+	_, err := conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, dnsMessageMax)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray answers of earlier queries
+		if n >= 2 && bytes.Equal(buffer[:2], query[:2]) {
+			return buffer[:n], nil
+		}
+	}
+}
+
+// ExchangeStream sends a query over a stream with the 2 bytes length prefix.
+func ExchangeStream(rw io.ReadWriter, query []byte) ([]byte, error) {
+	err := WriteDnsStream(rw, query)
+	if err != nil {
+		return nil, err
+	}
+	return ReadDnsStream(rw)
+}
+
+func WriteDnsStream(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+func ReadDnsStream(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func exchangeHTTPS(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh %s replied %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMessageMax))
+}
+
+func NewDnsQuery(host string, qtype dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(dnsFqdn(host))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+func dnsFqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+// DnsAnswer is the address part of a response, Ttl is the one to cache the
+// response with, taken from the SOA for negative answers.
+type DnsAnswer struct {
+	RCode dnsmessage.RCode
+	IPs   []net.IP
+	Ttl   time.Duration
+}
+
+func ParseDnsAnswer(resp []byte, negativeTtl time.Duration) (*DnsAnswer, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if h.Truncated {
+		return nil, errDnsTruncated
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	answer := &DnsAnswer{RCode: h.RCode}
+	ttl := uint32(math.MaxUint32)
+	records := 0
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			answer.IPs = append(answer.IPs, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			answer.IPs = append(answer.IPs, net.IP(r.AAAA[:]))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+		ttl = min(ttl, rh.TTL)
+		records++
+	}
+
+	if records > 0 {
+		answer.Ttl = time.Duration(ttl) * time.Second
+		return answer, nil
+	}
+
+	answer.Ttl = negativeTtl
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if p.SkipAuthority() != nil {
+				break
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		answer.Ttl = time.Duration(min(rh.TTL, soa.MinTTL)) * time.Second
+		break
+	}
+	return answer, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsServeTimeout = 10 * time.Second
+
+type DnsHandler = func(ctx context.Context, query []byte) ([]byte, error)
+
+func NewDnsServer(addr string, handler DnsHandler) *DnsServer {
+	return &DnsServer{
+		addr:    addr,
+		handler: handler,
+	}
+}
+
+// DnsServer answers queries on both udp and tcp of the same address.
+type DnsServer struct {
+	addr    string
+	handler DnsHandler
+}
+
+func (s *DnsServer) Serve() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	go s.serveTCP(l)
+	go s.servePacket(pc)
+	return nil
+}
+
+func (s *DnsServer) servePacket(pc net.PacketConn) {
+	defer pc.Close()
+	for {
+		buffer := make([]byte, dnsMessageMax)
+		n, addr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			log.Errorf("dns server %s udp stopped: %v", s.addr, err)
+			return
+		}
+
+		go func() {
+			resp, err := s.handle(buffer[:n])
+			if err != nil {
+				return
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *DnsServer) serveTCP(l net.Listener) {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Errorf("dns server %s tcp stopped: %v", s.addr, err)
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsServeTimeout))
+				query, err := ReadDnsStream(conn)
+				if err != nil {
+					return
+				}
+				resp, err := s.handle(query)
+				if err != nil {
+					return
+				}
+				if err = WriteDnsStream(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *DnsServer) handle(query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsServeTimeout)
+	defer cancel()
+
+	resp, err := s.handler(ctx, query)
+	if err != nil {
+		log.Debugf("dns server %s handle query failure: %v", s.addr, err)
+	}
+	return resp, err
+}
+
+func NewDnsReply(query *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+	}
+}
+
+func NewAddressResource(name dnsmessage.Name, ip net.IP, ttl uint32) dnsmessage.Resource {
+	header := dnsmessage.ResourceHeader{
+		Name:  name,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		header.Type = dnsmessage.TypeA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip4)}}
+	}
+	header.Type = dnsmessage.TypeAAAA
+	return dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type fakeIPsKey struct{}
+
+// WithFakeIPs makes the client handshakes restore the domains of the fake
+// addresses of pool.
+func WithFakeIPs(ctx context.Context, pool *FakeIPPool) context.Context {
+	return context.WithValue(ctx, fakeIPsKey{}, pool)
+}
+
+// fakeIPsOf is the pool of ctx, nil when the fake-ip DNS is disabled.
+func fakeIPsOf(ctx context.Context) *FakeIPPool {
+	pool, _ := ctx.Value(fakeIPsKey{}).(*FakeIPPool)
+	return pool
+}
+
+func NewFakeIPPool(ranges ...string) (*FakeIPPool, error) {
+	p := &FakeIPPool{
+		byDomain: make(map[string]netip.Addr),
+		byIP:     make(map[netip.Addr]string),
+	}
+	for _, r := range ranges {
+		if len(r) == 0 {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+			return nil, fmt.Errorf("fake ip range %s too small", r)
+		}
+		p.ranges = append(p.ranges, &fakeIPRange{prefix: prefix})
+	}
+	return p, nil
+}
+
+type fakeIPRange struct {
+	prefix netip.Prefix
+	last   netip.Addr
+}
+
+// next returns the address after the last given, it wraps around when the
+// range is exhausted so the oldest mapping gets reused.
+func (r *fakeIPRange) next() netip.Addr {
+	ip := r.last.Next()
+	if !r.last.IsValid() || !r.prefix.Contains(ip) || isRangeEnd(r.prefix, ip) {
+		// skip the network address
+		ip = r.prefix.Addr().Next()
+	}
+	r.last = ip
+	return ip
+}
+
+func isRangeEnd(prefix netip.Prefix, ip netip.Addr) bool {
+	return !prefix.Contains(ip.Next())
+}
+
+// FakeIPPool hands out synthetic addresses for domains and remembers the
+// domain behind each of them.
+type FakeIPPool struct {
+	sync.Mutex
+	ranges   []*fakeIPRange
+	byDomain map[string]netip.Addr
+	byIP     map[netip.Addr]string
+}
+
+// Lookup returns the fake address of domain in the family asked for, false
+// when no range of that family is configured.
+func (p *FakeIPPool) Lookup(domain string, ipv6 bool) (netip.Addr, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	p.Lock()
+	defer p.Unlock()
+
+	for _, r := range p.ranges {
+		if r.prefix.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		key := domain + "/" + strconv.FormatBool(ipv6)
+		if ip, ok := p.byDomain[key]; ok {
+			return ip, true
+		}
+
+		ip := r.next()
+		if old, ok := p.byIP[ip]; ok {
+			delete(p.byDomain, old+"/"+strconv.FormatBool(ipv6))
+		}
+		p.byDomain[key] = ip
+		p.byIP[ip] = domain
+		return ip, true
+	}
+	return netip.Addr{}, false
+}
+
+func (p *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	domain, ok := p.byIP[addr.Unmap()]
+	return domain, ok
+}
+
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	if p == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	for _, r := range p.ranges {
+		if r.prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore turns a request for a fake address back into one for its domain,
+// a fake address without one fails.
+func (p *FakeIPPool) Restore(req *Request) (*Request, error) {
+	ip := req.IPAddress()
+	if ip == nil || !p.Contains(ip.IP) {
+		return req, nil
+	}
+
+	// the server could only dial the meaningless fake address
+	domain, ok := p.Domain(ip.IP)
+	if !ok {
+		return nil, fmt.Errorf("fake ip %s has no domain, mapping expired", ip)
+	}
+
+	restored, err := NewRequest(req.CmdOrRep, net.JoinHostPort(domain, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("client - fake ip %s restored to %s", ip, domain)
+	return restored, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseForward parses [bind:]port:host:hostport as ssh -L does, IPv6
+// addresses go in brackets and the bind address defaults to loopback.
+func ParseForward(spec string) (*LocalForward, error) {
+	fields := splitForward(spec)
+	switch len(fields) {
+	case 3:
+		fields = append([]string{"127.0.0.1"}, fields...)
+	case 4:
+	default:
+		return nil, fmt.Errorf("forward %s is not [bind:]port:host:hostport", spec)
+	}
+	for _, field := range fields[1:] {
+		if len(field) == 0 {
+			return nil, fmt.Errorf("forward %s has an empty field", spec)
+		}
+	}
+
+	f := &LocalForward{
+		Listen: net.JoinHostPort(strings.Trim(fields[0], "[]"), fields[1]),
+		Target: net.JoinHostPort(strings.Trim(fields[2], "[]"), fields[3]),
+	}
+	// the target is sent as a socks request, check it can be
+	if _, err := NewRequest(CONNECT, f.Target); err != nil {
+		return nil, fmt.Errorf("forward %s: %v", spec, err)
+	}
+	return f, nil
+}
+
+// splitForward splits at the colons out of brackets.
+func splitForward(spec string) []string {
+	var fields []string
+	start, bracket := 0, false
+	for i, c := range spec {
+		switch c {
+		case '[':
+			bracket = true
+		case ']':
+			bracket = false
+		case ':':
+			if !bracket {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, spec[start:])
+}
+
+// LoadForwards reads the mappings of the flags and of a file with one
+// mapping per line, # starts a comment.
+func LoadForwards(specs []string, path string) ([]*LocalForward, error) {
+	if len(path) > 0 {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			text, _, _ := strings.Cut(scanner.Text(), "#")
+			if text = strings.TrimSpace(text); len(text) > 0 {
+				specs = append(specs, text)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var forwards []*LocalForward
+	for _, spec := range specs {
+		f, err := ParseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// LocalForward tunnels every connection accepted on Listen to Target, no
+// handshake is done with the local client.
+type LocalForward struct {
+	Listen   string
+	Target   string
+	listener net.Listener
+}
+
+// Serve listens then accepts in the background, dial opens the tunnels.
+func (f *LocalForward) Serve(ctx context.Context, dial DialTunnel, allow Allowlist) error {
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	f.listener = allow.Listener(l)
+	log.Infof("client - forward %s to %s", f.Listen, f.Target)
+
+	go func() {
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				log.Errorf("client forward %s stopped: %v", f.Listen, err)
+				return
+			}
+			go f.accept(ctx, conn, dial)
+		}
+	}()
+	return nil
+}
+
+func (f *LocalForward) Close() error {
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Close()
+}
+
+func (f *LocalForward) accept(ctx context.Context, conn net.Conn, dial DialTunnel) {
+	tunnel, err := dial(ctx, f.Target)
+	if err != nil {
+		log.Errorf("client forward %s to %s error: %v", conn.RemoteAddr(), f.Target, err)
+		conn.Close()
+		return
+	}
+	log.Debugf("client - forward %s to %s", conn.RemoteAddr(), f.Target)
+	tunnel = activeTunnels.Track(tunnel, f.Target, conn.RemoteAddr())
+
+	NewProxyConnection(tunnel, conn).TunnelTraffic()
+}
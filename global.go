@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,12 +15,85 @@ const (
 )
 
 type Args struct {
-	Mode        string `arg:"required"`
-	Secret      string
-	ClientCount int
-	ServerUrl   string
-	ListenPort  int
-	Verbose     bool
+	Mode          string `arg:"required"`
+	Secret        string
+	ClientCount   int
+	Balance       string `default:"least-tunnels"`
+	ServerUrl     string
+	Server        []string
+	Profiles      string
+	ListenPort    int
+	Listen        []string
+	Allow         []string
+	ProxyAuth     string
+	Sniff         string
+	DnsServer     []string
+	DnsPrefer     []string
+	DnsCacheSize  int `default:"4096"`
+	MetricsListen string
+
+	DnsListen     string
+	FakeIP        bool
+	FakeIPv4Range string `default:"198.18.0.0/15"`
+	FakeIPv6Range string `default:"fdfe:dcba:9876::/48"`
+	FakeIPExclude []string
+	TunnelDns     []string
+	DnsDirect     []string
+
+	TlsCa         string
+	TlsPin        []string
+	TlsServerName string
+	TlsMinVersion string `default:"1.2"`
+	Insecure      bool
+	TlsCert       string
+	TlsKey        string
+	TlsClientCert string
+	TlsClientKey  string
+	TlsClientCa   string
+	TlsCrl        string
+	TlsIdentity   string `default:"subject"`
+
+	UpstreamProxy    string
+	UpstreamProxyEnv bool
+
+	WsHeader      []string
+	WsHost        string
+	WsUserAgent   string
+	WsOrigin      string
+	WsSubprotocol []string
+	WsRoute       []string
+
+	Rules     string
+	GeoIP     string
+	RouteTest []string
+
+	Forward      []string
+	ForwardFile  string
+	Reverse      []string
+	ReverseAllow []string
+
+	Agent         string
+	AgentListen   []string
+	AgentPassword string
+	AgentAllow    []string
+
+	RedirListen  string
+	TproxyListen string
+
+	ReconnectDelay    time.Duration `default:"1s"`
+	ReconnectMaxDelay time.Duration `default:"1m"`
+	HealthInterval    time.Duration `default:"30s"`
+	HealthTimeout     time.Duration `default:"5s"`
+
+	DialTimeout      time.Duration `default:"10s"`
+	DialAttemptDelay time.Duration `default:"250ms"`
+	DialMaxAddrs     int           `default:"4"`
+	DialKeepAlive    time.Duration `default:"30s"`
+
+	Control string
+	Watch   time.Duration
+
+	Verbose bool
 }
 
 var args = &Args{}
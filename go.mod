@@ -2,13 +2,16 @@ module github.com/yingshulu/wssocks5
 
 go 1.22.0
 
-require github.com/gorilla/websocket v1.5.3
-
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+)
 
 require (
-	github.com/alexflint/go-arg v1.5.1 // indirect
+	github.com/alexflint/go-arg v1.5.1
 	github.com/alexflint/go-scalar v1.2.0 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/text v0.21.0 // indirect
 )
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -15,45 +17,71 @@ type Phase = string
 const (
 	initPhase          = "Init"
 	readMethodRequest  = "ReadMethodRequest"
-	parseMethodRequest = "ParseMethodRequest"
 	writeMethodReply   = "WriteMethodReply"
 	readSocks5Request  = "ReadSocks5Request"
-	parseSocks5Request = "ParseSocks5Request"
 	newProxyConnection = "NewProxyConnection"
 	writeMethodRequest = "WriteMethodRequest"
 	readMethodReply    = "ReadMethodReply"
-	parseMethodReply   = "ParseMethodReply"
 	writeSocks5Request = "WriteSocks5Request"
 	readSocks5Reply    = "ReadSocks5Reply"
-	parseSocks5Reply   = "ParseSocks5Reply"
 	writeSocks5Reply   = "WriteSocks5Reply"
 	failureSocks5Reply = "Socks5ReplyFailure"
+	readSocks4Request  = "ReadSocks4Request"
+	tunnelHandshake    = "TunnelHandshake"
+	readUserPasswd     = "ReadUserPassword"
+	writeAuthStatus    = "WriteAuthStatus"
+	restoreFakeIP      = "RestoreFakeIP"
 )
 
-type NewConnection = func(ctx context.Context) (io.ReadWriteCloser, error)
+// NewConnection opens the tunnel for req, req is only a hint for choosing
+// the session.
+type NewConnection = func(ctx context.Context, req *Request) (io.ReadWriteCloser, error)
 
-func SendSocks5Reply(w io.Writer, req *Request, rep byte) error {
-	reply := &Reply{
-		Ver:      Socks5Version,
-		CmdOrRep: rep,
+type DialTarget = func(ctx context.Context, network string, req *Request) (net.Conn, error)
+
+type socksUserKey struct{}
+
+// CheckSocksUser tells whether password is the one of the socks user.
+type CheckSocksUser = func(user, password string) bool
+
+type socksUser struct {
+	name  *string
+	check CheckSocksUser
+}
+
+// WithSocksUser makes the socks handshakes require a username and password
+// passing check, the username is kept in user.
+func WithSocksUser(ctx context.Context, user *string, check CheckSocksUser) context.Context {
+	return context.WithValue(ctx, socksUserKey{}, &socksUser{name: user, check: check})
+}
+
+// SendSocks5Reply reports bound as BND.ADDR and BND.PORT, a nil bound is
+// sent as 0.0.0.0:0.
+func SendSocks5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	_, err := w.Write(NewReply(rep, bound).Encode())
+	return err
+}
+
+func ProxyHandshake(ctx context.Context, c *BufferedConn, newConn NewConnection) (io.ReadWriteCloser, error) {
+	b, err := c.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "[proxy handshake] peek protocol")
 	}
-	if req != nil {
-		reply.Atyp = req.Atyp
-		reply.Addr = req.Addr
-		reply.Port = req.Port
-	} else {
-		reply.Atyp = IPV4
-		reply.Addr = []byte{0, 0, 0, 0}
+
+	switch {
+	case b[0] == Socks4Version || b[0] == Socks5Version:
+		return SocksHandshake(ctx, c, newConn)
+	case isHTTPMethodStart(b[0]):
+		return HTTPProxyHandshake(ctx, c, newConn)
 	}
-	_, err := w.Write(reply.Encode())
-	return err
+	return nil, fmt.Errorf("[proxy handshake] unknown protocol byte 0x%02x", b[0])
 }
 
-func ProxyHandshake(ctx context.Context, c io.ReadWriteCloser, newConn NewConnection) (s io.ReadWriteCloser, err error) {
+func SocksHandshake(ctx context.Context, c *BufferedConn, newConn NewConnection) (s io.ReadWriteCloser, err error) {
 	var (
-		n      int
-		buffer = make([]byte, 1024)
-		phase  = initPhase
+		req       *Request
+		phase     = initPhase
+		sendReply = SendSocks5Reply
 	)
 
 	defer func() {
@@ -64,109 +92,207 @@ func ProxyHandshake(ctx context.Context, c io.ReadWriteCloser, newConn NewConnec
 		}
 	}()
 
-	n, err = c.Read(buffer)
+	b, err := c.Peek(1)
 	if err != nil {
 		phase = readMethodRequest
 		return
 	}
 
-	_, err = ParseMethodRequest(buffer[:n])
-	if err != nil {
-		phase = parseMethodRequest
-		return
-	}
+	user, _ := ctx.Value(socksUserKey{}).(*socksUser)
+	version := b[0]
+	switch version {
+	case Socks4Version:
+		sendReply = SendSocks4Reply
+		// socks4 has no password
+		if user != nil {
+			phase = readSocks4Request
+			err = errors.New("socks4 client without password")
+			sendReply(c, NOTALLOW, nil)
+			return
+		}
+		var r4 *Socks4Request
+		r4, err = ReadSocks4Request(c.Reader())
+		if err != nil {
+			phase = readSocks4Request
+			sendReply(c, REFUSED, nil)
+			return
+		}
+		if r4.Cmd != CONNECT {
+			phase = readSocks4Request
+			err = fmt.Errorf("socks4 command %d not supported", r4.Cmd)
+			sendReply(c, CMDNSUPP, nil)
+			return
+		}
+		req = r4.Request()
 
-	methodReply := &MethodReply{Socks5Version, NOAUTH}
-	_, err = c.Write(methodReply.Encode())
-	if err != nil {
-		phase = writeMethodReply
-		return
+	default:
+		var methodRequest *MethodRequest
+		methodRequest, err = ReadMethodRequest(c.Reader())
+		if err != nil {
+			phase = readMethodRequest
+			return
+		}
+
+		methodReply := &MethodReply{Socks5Version, NOAUTH}
+		if user != nil {
+			methodReply.Method = NOACPT
+			if bytes.IndexByte(methodRequest.Methods, UPASSW) >= 0 {
+				methodReply.Method = UPASSW
+			}
+		}
+		_, err = c.Write(methodReply.Encode())
+		if err != nil {
+			phase = writeMethodReply
+			return
+		}
+		if methodReply.Method == NOACPT {
+			phase = writeMethodReply
+			err = errors.New("client offers no username and password")
+			return
+		}
+
+		if methodReply.Method == UPASSW {
+			var name, password string
+			name, password, err = readUserPassword(c)
+			if err != nil {
+				phase = readUserPasswd
+				return
+			}
+			status := []byte{upasswVersion, upasswSuccess}
+			if !user.check(name, password) {
+				status[1] = authFailureStatus
+			}
+			_, err = c.Write(status)
+			if err != nil {
+				phase = writeAuthStatus
+				return
+			}
+			if status[1] != upasswSuccess {
+				phase = writeAuthStatus
+				err = fmt.Errorf("password of %s rejected", name)
+				return
+			}
+			*user.name = name
+		}
+
+		req, err = ReadRequest(c.Reader())
+		if err != nil {
+			phase = readSocks5Request
+			sendReply(c, REFUSED, nil)
+			return
+		}
 	}
 
-	n, err = c.Read(buffer)
+	req, err = fakeIPsOf(ctx).Restore(req)
 	if err != nil {
-		phase = readSocks5Request
+		phase = restoreFakeIP
+		sendReply(c, HUNREACH, nil)
 		return
 	}
 
-	req, err := ParseRequest(buffer[:n])
-	if err != nil {
-		phase = parseSocks5Request
-		SendSocks5Reply(c, req, REFUSED)
-		return
+	// the client only sends its first bytes once granted, the reply of the
+	// server can not be waited for when sniffing
+	sniffing := sniffEnabled() && req.Atyp != DOMAIN
+	if sniffing {
+		err = sendReply(c, SUCCEEDED, nil)
+		if err != nil {
+			phase = writeSocks5Reply
+			return
+		}
+		req = SniffRequest(c, req)
 	}
 
 	log.Debugf("client - try to tunnel to address %s", req.Address())
 
-	s, err = newConn(ctx)
+	s, reply, err := TunnelHandshake(ctx, req, newConn)
 	if err != nil {
-		phase = newProxyConnection
+		phase = tunnelHandshake
+		if !sniffing {
+			sendReply(c, tunnelReplyCode(err), nil)
+		}
 		return
 	}
-	methodRequest := &MethodRequest{Socks5Version, 1, []uint8{NOAUTH}}
-	_, err = s.Write(methodRequest.Encode())
-	if err != nil {
-		phase = writeMethodRequest
-		SendSocks5Reply(c, req, REFUSED)
+
+	if sniffing {
+		if reply.CmdOrRep != SUCCEEDED {
+			phase = failureSocks5Reply
+			err = fmt.Errorf("socks5 Reply with error: %v", reply.CmdOrRep)
+		}
 		return
 	}
 
-	n, err = s.Read(buffer)
+	if version == Socks4Version {
+		err = sendReply(c, reply.CmdOrRep, reply.NetAddr())
+	} else {
+		_, err = c.Write(reply.Encode())
+	}
 	if err != nil {
-		phase = readMethodReply
-		SendSocks5Reply(c, req, REFUSED)
+		phase = writeSocks5Reply
 		return
 	}
 
-	_, err = ParseMethodReply(buffer[:n])
-	if err != nil {
-		phase = parseMethodReply
-		SendSocks5Reply(c, req, REFUSED)
+	if reply.CmdOrRep != SUCCEEDED {
+		phase = failureSocks5Reply
+		err = fmt.Errorf("socks5 Reply with error: %v", reply.CmdOrRep)
 		return
 	}
 
-	_, err = s.Write(req.Encode())
+	return
+}
+
+// TunnelHandshake opens a tunnel and negotiates req with the server, a
+// failure reply from the server is returned as is without error.
+func TunnelHandshake(ctx context.Context, req *Request, newConn NewConnection) (s io.ReadWriteCloser, reply *Reply, err error) {
+	var (
+		phase = initPhase
+		conn  io.ReadWriteCloser
+	)
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "error on phase: %s", phase)
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	conn, err = newConn(ctx, req)
 	if err != nil {
-		phase = writeSocks5Request
-		SendSocks5Reply(c, req, REFUSED)
+		phase = newProxyConnection
 		return
 	}
+	bc := NewBufferedConn(conn)
 
-	n, err = s.Read(buffer)
+	methodRequest := &MethodRequest{Socks5Version, 1, []uint8{NOAUTH}}
+	_, err = bc.Write(methodRequest.Encode())
 	if err != nil {
-		phase = readSocks5Reply
-		SendSocks5Reply(c, req, REFUSED)
+		phase = writeMethodRequest
 		return
 	}
 
-	reply, err := ParseReply(buffer[:n])
+	_, err = ReadMethodReply(bc.Reader())
 	if err != nil {
-		phase = parseSocks5Reply
-		SendSocks5Reply(c, req, REFUSED)
+		phase = readMethodReply
 		return
 	}
 
-	_, err = c.Write(buffer[:n])
+	_, err = bc.Write(req.Encode())
 	if err != nil {
-		phase = writeSocks5Reply
+		phase = writeSocks5Request
 		return
 	}
 
-	if reply.CmdOrRep != SUCCEEDED {
-		phase = failureSocks5Reply
-		err = fmt.Errorf("socks5 Reply with error: %v", reply.CmdOrRep)
+	reply, err = ReadReply(bc.Reader())
+	if err != nil {
+		phase = readSocks5Reply
 		return
 	}
-
-	return
+	return bc, reply, nil
 }
 
-func ServerHandshake(c io.ReadWriteCloser) (s io.ReadWriteCloser, err error) {
-	var (
-		n      int
-		buffer = make([]byte, 1024)
-		phase  = initPhase
-	)
+func ServerHandshake(ctx context.Context, c *BufferedConn, dial DialTarget) (s io.ReadWriteCloser, err error) {
+	var phase = initPhase
 
 	defer func() {
 		if err != nil {
@@ -176,18 +302,12 @@ func ServerHandshake(c io.ReadWriteCloser) (s io.ReadWriteCloser, err error) {
 		}
 	}()
 
-	n, err = c.Read(buffer)
+	_, err = ReadMethodRequest(c.Reader())
 	if err != nil {
 		phase = readMethodRequest
 		return
 	}
 
-	_, err = ParseMethodRequest(buffer[:n])
-	if err != nil {
-		phase = parseMethodRequest
-		return
-	}
-
 	methodReply := &MethodReply{Socks5Version, NOAUTH}
 	_, err = c.Write(methodReply.Encode())
 	if err != nil {
@@ -195,16 +315,10 @@ func ServerHandshake(c io.ReadWriteCloser) (s io.ReadWriteCloser, err error) {
 		return
 	}
 
-	n, err = c.Read(buffer)
+	req, err := ReadRequest(c.Reader())
 	if err != nil {
 		phase = readSocks5Request
-		return
-	}
-
-	req, err := ParseRequest(buffer[:n])
-	if err != nil {
-		phase = parseSocks5Request
-		SendSocks5Reply(c, req, REFUSED)
+		SendSocks5Reply(c, REFUSED, nil)
 		return
 	}
 
@@ -215,17 +329,45 @@ func ServerHandshake(c io.ReadWriteCloser) (s io.ReadWriteCloser, err error) {
 
 	log.Debugf("server - try to connect %s://%s", network, req.Address())
 
-	s, err = net.Dial(network, req.Address())
+	conn, err := dial(ctx, network, req)
 	if err != nil {
 		phase = fmt.Sprintf("connect to Remote %s://%s", network, req.Address())
-		SendSocks5Reply(c, req, UNREACH)
+		SendSocks5Reply(c, dialReplyCode(err), nil)
 		return
 	}
 
-	err = SendSocks5Reply(c, req, SUCCEEDED)
+	s = conn
+	err = SendSocks5Reply(c, SUCCEEDED, conn.LocalAddr())
 	if err != nil {
 		phase = writeSocks5Reply
 		return
 	}
 	return
 }
+
+// tunnelReplyCode is the reply of a tunnel which could not be negotiated,
+// the failure is on our side while no session is connected.
+func tunnelReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, errNoSession):
+		return GENERAL
+	case errors.Is(err, errRejected):
+		return NOTALLOW
+	}
+	return REFUSED
+}
+
+func dialReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errRejected):
+		return NOTALLOW
+	case errors.Is(err, context.DeadlineExceeded):
+		return TTLEXPIRE
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return REFUSED
+	case errors.As(err, &dnsErr):
+		return HUNREACH
+	}
+	return UNREACH
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	readHTTPRequest   = "ReadHTTPRequest"
+	checkHTTPAuth     = "CheckProxyAuthorization"
+	parseHTTPTarget   = "ParseHTTPTarget"
+	writeHTTPRequest  = "WriteHTTPRequest"
+	writeHTTPResponse = "WriteHTTPResponse"
+)
+
+// headers only meaningful for a single hop, never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+func connectionTokens(h http.Header) []string {
+	var tokens []string
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if token = textproto.TrimString(token); len(token) > 0 {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func upgradeProtocol(h http.Header) string {
+	for _, token := range connectionTokens(h) {
+		if strings.EqualFold(token, "Upgrade") {
+			return h.Get("Upgrade")
+		}
+	}
+	return ""
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, token := range connectionTokens(h) {
+		h.Del(token)
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func checkProxyAuth(r *http.Request) bool {
+	if len(args.ProxyAuth) == 0 {
+		return true
+	}
+
+	const prefix = "Basic "
+	auth := r.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	credential, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(credential, []byte(args.ProxyAuth)) == 1
+}
+
+func httpTargetAddress(r *http.Request) (string, error) {
+	if r.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(r.Host); err != nil {
+			return "", err
+		}
+		return r.Host, nil
+	}
+
+	if !r.URL.IsAbs() || len(r.URL.Host) == 0 {
+		return "", fmt.Errorf("request uri %s is not absolute", r.RequestURI)
+	}
+	if !strings.EqualFold(r.URL.Scheme, "http") {
+		return "", fmt.Errorf("scheme %s not supported", r.URL.Scheme)
+	}
+	port := r.URL.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port), nil
+}
+
+func httpReplyStatus(rep byte) int {
+	switch rep {
+	case GENERAL:
+		return http.StatusServiceUnavailable
+	case NOTALLOW:
+		return http.StatusForbidden
+	case TTLEXPIRE:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func SendHTTPError(w io.Writer, code int, header string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n",
+		code, http.StatusText(code), header)
+	return err
+}
+
+// HTTPProxyHandshake serves a CONNECT or an absolute-uri request, the forward
+// case gets a single request per connection so hop-by-hop headers are handled
+// on both directions.
+func HTTPProxyHandshake(ctx context.Context, c *BufferedConn, newConn NewConnection) (s io.ReadWriteCloser, err error) {
+	var (
+		r     *http.Request
+		req   *Request
+		reply *Reply
+		phase = initPhase
+	)
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "[http proxy handshake] error on phase: %s", phase)
+			log.Error(err)
+			return
+		}
+	}()
+
+	r, err = http.ReadRequest(c.Reader())
+	if err != nil {
+		phase = readHTTPRequest
+		SendHTTPError(c, http.StatusBadRequest, "")
+		return
+	}
+
+	if !checkProxyAuth(r) {
+		phase = checkHTTPAuth
+		err = errors.New("proxy authorization failure")
+		SendHTTPError(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"wssocks5\"\r\n")
+		return
+	}
+
+	address, err := httpTargetAddress(r)
+	if err == nil {
+		req, err = NewRequest(CONNECT, address)
+	}
+	if err != nil {
+		phase = parseHTTPTarget
+		SendHTTPError(c, http.StatusBadRequest, "")
+		return
+	}
+
+	req, err = fakeIPsOf(ctx).Restore(req)
+	if err != nil {
+		phase = restoreFakeIP
+		SendHTTPError(c, httpReplyStatus(HUNREACH), "")
+		return
+	}
+
+	sniffing := sniffEnabled() && r.Method == http.MethodConnect && req.Atyp != DOMAIN
+	if sniffing {
+		err = writeConnectEstablished(c)
+		if err != nil {
+			phase = writeHTTPResponse
+			return
+		}
+		req = SniffRequest(c, req)
+	}
+
+	log.Debugf("client - try to tunnel http %s to address %s", r.Method, req.Address())
+
+	s, reply, err = TunnelHandshake(ctx, req, newConn)
+	if err != nil {
+		phase = tunnelHandshake
+		if !sniffing {
+			SendHTTPError(c, httpReplyStatus(tunnelReplyCode(err)), "")
+		}
+		return
+	}
+
+	if reply.CmdOrRep != SUCCEEDED {
+		phase = failureSocks5Reply
+		err = fmt.Errorf("socks5 Reply with error: %v", reply.CmdOrRep)
+		if !sniffing {
+			SendHTTPError(c, httpReplyStatus(reply.CmdOrRep), "")
+		}
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		if !sniffing {
+			err = writeConnectEstablished(c)
+		}
+		if err != nil {
+			phase = writeHTTPResponse
+		}
+		return
+	}
+
+	upgrade := upgradeProtocol(r.Header)
+	removeHopHeaders(r.Header)
+	if len(upgrade) > 0 {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", upgrade)
+	} else {
+		r.Close = true
+	}
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// keep Write from adding its default one
+		r.Header["User-Agent"] = []string{""}
+	}
+
+	err = r.Write(s)
+	if err != nil {
+		phase = writeHTTPRequest
+		SendHTTPError(c, http.StatusBadGateway, "")
+		return
+	}
+	return newHTTPResponseConn(s, r), nil
+}
+
+func writeConnectEstablished(w io.Writer) error {
+	_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+func newHTTPResponseConn(s io.ReadWriteCloser, r *http.Request) io.ReadWriteCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(relayHTTPResponse(pw, s, r))
+	}()
+	return &httpResponseConn{
+		ReadWriteCloser: s,
+		pr:              pr,
+	}
+}
+
+// httpResponseConn reads the response of a forwarded request with the
+// hop-by-hop headers rewritten, writes go to the tunnel untouched.
+type httpResponseConn struct {
+	io.ReadWriteCloser
+	pr *io.PipeReader
+}
+
+func (c *httpResponseConn) Read(b []byte) (int, error) {
+	return c.pr.Read(b)
+}
+
+func (c *httpResponseConn) Close() error {
+	c.pr.Close()
+	return c.ReadWriteCloser.Close()
+}
+
+func relayHTTPResponse(w io.Writer, s io.Reader, r *http.Request) error {
+	br := bufio.NewReader(s)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	upgrade := resp.Header.Get("Upgrade")
+	switched := resp.StatusCode == http.StatusSwitchingProtocols
+	removeHopHeaders(resp.Header)
+	if switched {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgrade)
+	} else {
+		resp.Close = true
+	}
+
+	err = resp.Write(w)
+	if err != nil || !switched {
+		return err
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenAddresses are the addresses of the client proxy, a bare port and
+// --listenport are on loopback.
+func ListenAddresses(listen []string, port int) ([]string, error) {
+	if len(listen) == 0 {
+		if port <= 0 {
+			return nil, fmt.Errorf("no listen address, give --listen or --listenport")
+		}
+		return []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}, nil
+	}
+
+	var addrs []string
+	for _, addr := range listen {
+		if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+			addr = net.JoinHostPort("127.0.0.1", addr)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("listen address %s: %v", addr, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func ParseAllowlist(cidrs []string) (Allowlist, error) {
+	var allow Allowlist
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("allow %s: %v", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		allow = append(allow, prefix.Masked())
+	}
+	return allow, nil
+}
+
+// Allowlist holds the networks which may connect to the client, anyone may
+// when empty and loopback always may.
+type Allowlist []netip.Prefix
+
+func (a Allowlist) Allowed(addr net.Addr) bool {
+	if len(a) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip.IsLoopback() || a.Contains(addr)
+}
+
+// Contains tells whether addr is in one of the networks.
+func (a Allowlist) Contains(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range a {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) netip.Addr {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+	ip, _ := netip.AddrFromSlice(tcpAddr.IP)
+	return ip.Unmap()
+}
+
+// Listener drops the connections of the sources not allowed on l.
+func (a Allowlist) Listener(l net.Listener) net.Listener {
+	if len(a) == 0 {
+		return l
+	}
+	return &allowListener{Listener: l, allow: a}
+}
+
+type allowListener struct {
+	net.Listener
+	allow Allowlist
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allow.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Warnf("client - connection from %s to %s not allowed", conn.RemoteAddr(), l.Addr())
+		conn.Close()
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/alexflint/go-arg"
 	log "github.com/sirupsen/logrus"
 )
@@ -15,10 +17,59 @@ func main() {
 	switch args.Mode {
 	case "server":
 		s := NewServer(args.ServerUrl)
-		s.Serve()
+		err := s.Serve()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "route":
+		router, err := LoadRouter(args.Rules, args.GeoIP)
+		if err == nil {
+			err = TestRoutes(os.Stdout, router, args.RouteTest)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "status":
+		err := ShowStatus(os.Stdout, args.Control, args.Watch)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 	case "client":
-		p := NewClientProxy(args.ListenPort, args.ServerUrl, true)
-		p.Serve()
+		err := CheckReconnectDelays(args.ReconnectDelay, args.ReconnectMaxDelay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profiles, err := LoadProfiles(args.Profiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var servers []*ServerEndpoint
+		for _, p := range profiles {
+			servers = append(servers, p.Endpoints...)
+		}
+		upstream, err := NewUpstreamProxy(args.UpstreamProxy, args.UpstreamProxyEnv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig, err := ClientTLSConfig(servers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listens, err := ListenAddresses(args.Listen, args.ListenPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		allow, err := ParseAllowlist(args.Allow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p := NewClientProxy(listens, allow, profiles, upstream, tlsConfig)
+		err = p.Serve()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
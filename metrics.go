@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var metrics = expvar.NewMap("wssocks5")
+
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+func NewLatencyHistogram(name string) *LatencyHistogram {
+	h := &LatencyHistogram{
+		counts: make([]int64, len(latencyBuckets)+1),
+	}
+	metrics.Set(name, h)
+	return h
+}
+
+// LatencyHistogram is an expvar.Var counting latencies per bucket, bucket
+// bounds are upper limits in milliseconds.
+type LatencyHistogram struct {
+	sync.Mutex
+	counts []int64
+	count  int64
+	sum    time.Duration
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *LatencyHistogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"count": %d, "sum_ms": %.3f, "buckets": {`, h.count, float64(h.sum)/float64(time.Millisecond))
+	for i, n := range h.counts {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = fmt.Sprint(latencyBuckets[i].Milliseconds())
+		}
+		fmt.Fprintf(&b, `"%s": %d`, le, n)
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// ServeMetrics serves the expvars, and status on /status when given.
+func ServeMetrics(addr string, status http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if status != nil {
+		mux.Handle("/status", status)
+	}
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		log.Errorf("metrics listener %s stopped: %v", addr, err)
+	}()
+}
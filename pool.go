@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	BalanceLeastTunnels = "least-tunnels"
+	BalanceLowestRtt    = "lowest-rtt"
+	BalanceRoundRobin   = "round-robin"
+	BalanceHash         = "hash-destination"
+
+	// points of each session on the hash ring
+	hashReplicas = 64
+)
+
+var errNoSession = errors.New("no session connected")
+
+type hashPoint struct {
+	hash    uint32
+	session *Socks5WsProxy
+}
+
+func NewSessionPool(sessions []*Socks5WsProxy, policy string) (*SessionPool, error) {
+	switch policy {
+	case BalanceLeastTunnels, BalanceLowestRtt, BalanceRoundRobin, BalanceHash:
+	default:
+		return nil, fmt.Errorf("unknown balance policy %s", policy)
+	}
+
+	p := &SessionPool{
+		sessions: sessions,
+		policy:   policy,
+		next:     &atomic.Uint32{},
+	}
+	p.connect = p.openTunnel
+	for i, s := range sessions {
+		for r := 0; r < hashReplicas; r++ {
+			p.ring = append(p.ring, hashPoint{hashString(strconv.Itoa(i) + "#" + strconv.Itoa(r)), s})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p, nil
+}
+
+// SessionPool picks the session of every new connection by policy, skipping
+// the sessions being reconnected.
+type SessionPool struct {
+	sessions []*Socks5WsProxy
+	policy   string
+	next     *atomic.Uint32
+	ring     []hashPoint
+	// connect opens the connections of the clients, through the rules
+	// when routing is set
+	connect NewConnection
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (p *SessionPool) Close() error {
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	return nil
+}
+
+// pick returns the session for req, nil when none is ready.
+func (p *SessionPool) pick(req *Request) *Socks5WsProxy {
+	var ready []*Socks5WsProxy
+	for _, s := range p.sessions {
+		if s.Ready() {
+			ready = append(ready, s)
+		}
+	}
+	if len(ready) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case BalanceRoundRobin:
+		return ready[int(p.next.Add(1))%len(ready)]
+
+	case BalanceHash:
+		return p.pickHash(req)
+
+	case BalanceLowestRtt:
+		best := ready[0]
+		for _, s := range ready[1:] {
+			// unmeasured sessions go first to get measured
+			if rtt := s.Rtt(); rtt < best.Rtt() {
+				best = s
+			}
+		}
+		return best
+	}
+
+	best, count := ready[0], ready[0].TunnelCount()
+	for _, s := range ready[1:] {
+		if n := s.TunnelCount(); n < count {
+			best, count = s, n
+		}
+	}
+	return best
+}
+
+// pickHash walks the ring from the destination host, a destination keeps
+// its session as long as that one is ready.
+func (p *SessionPool) pickHash(req *Request) *Socks5WsProxy {
+	h := hashString(req.Host())
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	for n := 0; n < len(p.ring); n++ {
+		point := p.ring[(i+n)%len(p.ring)]
+		if point.session.Ready() {
+			return point.session
+		}
+	}
+	return nil
+}
+
+func (p *SessionPool) openTunnel(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+	s := p.pick(req)
+	if s == nil {
+		return nil, errNoSession
+	}
+	return s.openTunnel(ctx, req)
+}
+
+// DialTunnel connects address from the server, without a local handshake.
+func (p *SessionPool) DialTunnel(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+	return dialTunnel(ctx, address, p.connect)
+}
+
+func dialTunnel(ctx context.Context, address string, connect NewConnection) (io.ReadWriteCloser, error) {
+	req, err := NewRequest(CONNECT, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s, reply, err := TunnelHandshake(ctx, req, connect)
+	if err != nil {
+		return nil, err
+	}
+	if reply.CmdOrRep != SUCCEEDED {
+		s.Close()
+		return nil, fmt.Errorf("tunnel to %s replied with error: %v", address, reply.CmdOrRep)
+	}
+	return s, nil
+}
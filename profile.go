@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+const defaultProfile = "default"
+
+// LoadProfiles returns the default profile of the flags followed by the
+// ones of the profiles file, if any.
+func LoadProfiles(path string) ([]*Profile, error) {
+	endpoints, err := ParseServerEndpoints(args.ServerUrl, args.Server)
+	if err != nil {
+		return nil, err
+	}
+	profiles := []*Profile{{Name: defaultProfile, Endpoints: endpoints, Rules: args.Rules}}
+	if len(path) > 0 {
+		profiles, err = loadProfileFile(profiles, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range profiles {
+		if err = ResolveChains(p.Endpoints); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	return profiles, nil
+}
+
+func loadProfileFile(profiles []*Profile, path string) ([]*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p *Profile
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			for _, known := range profiles {
+				if known.Name == name {
+					return nil, fmt.Errorf("profiles line %d: profile %s given twice", line, name)
+				}
+			}
+			p = &Profile{Name: name}
+			profiles = append(profiles, p)
+			continue
+		}
+		if p == nil {
+			return nil, fmt.Errorf("profiles line %d: no [profile] before", line)
+		}
+
+		key, value, found := strings.Cut(text, "=")
+		if !found {
+			return nil, fmt.Errorf("profiles line %d: not key = value", line)
+		}
+		if err = p.set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("profiles line %d: %v", line, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	for _, p := range profiles[1:] {
+		if len(p.Endpoints) == 0 {
+			return nil, fmt.Errorf("profile %s has no server", p.Name)
+		}
+		for user := range p.Users {
+			if known, ok := users[user]; ok {
+				return nil, fmt.Errorf("user %s in profiles %s and %s", user, known, p.Name)
+			}
+			users[user] = p.Name
+		}
+		for _, s := range p.Endpoints {
+			if len(s.Secret) == 0 {
+				s.Secret = p.Secret
+			}
+		}
+	}
+	return profiles, nil
+}
+
+func (p *Profile) set(key, value string) error {
+	switch key {
+	case "server":
+		s, err := ParseServerEndpoint(value)
+		if err != nil {
+			return err
+		}
+		p.Endpoints = append(p.Endpoints, s)
+	case "secret":
+		p.Secret = value
+	case "rules":
+		p.Rules = value
+	case "listen":
+		addrs, err := ListenAddresses([]string{value}, 0)
+		if err != nil {
+			return err
+		}
+		p.Listen = append(p.Listen, addrs...)
+	case "source":
+		sources, err := ParseAllowlist([]string{value})
+		if err != nil {
+			return err
+		}
+		p.Sources = append(p.Sources, sources...)
+	case "user":
+		name, password, found := strings.Cut(value, ":")
+		if !found || len(name) == 0 || len(password) == 0 {
+			return fmt.Errorf("user %s is not name:password", value)
+		}
+		if p.Users == nil {
+			p.Users = make(map[string]string)
+		}
+		p.Users[name] = password
+	default:
+		return fmt.Errorf("unknown key %s", key)
+	}
+	return nil
+}
+
+// Profile is a set of servers with their own sessions, secret and rules,
+// taken by its listeners, its sources or its socks usernames.
+type Profile struct {
+	Name      string
+	Endpoints []*ServerEndpoint
+	Secret    string
+	Rules     string
+	Listen    []string
+	Sources   Allowlist
+	Users     map[string]string
+
+	servers *ServerGroup
+	pool    *SessionPool
+	named   map[string]*Socks5WsProxy
+}
+
+// start connects the sessions of the profile.
+func (p *Profile) start(c *ClientProxy) error {
+	p.servers = NewServerGroup(p.Endpoints, c.wsDispatcher)
+	clientCount := int(math.Max(float64(args.ClientCount), 1))
+	sessions := make([]*Socks5WsProxy, clientCount)
+	for i := 0; i < clientCount; i++ {
+		sessions[i] = NewSocks5WsProxy(context.Background(), p.servers.Dispatcher)
+	}
+
+	var err error
+	p.pool, err = NewSessionPool(sessions, args.Balance)
+	if err != nil {
+		return err
+	}
+	if len(p.Rules) > 0 {
+		err = p.route(c.direct)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	go p.servers.HealthCheck(context.Background(), args.HealthInterval, args.HealthTimeout)
+	return nil
+}
+
+// route sends the connections through the rules, servers named by them get
+// a session of their own.
+func (p *Profile) route(direct *Resolver) error {
+	router, err := LoadRouter(p.Rules, args.GeoIP)
+	if err != nil {
+		return err
+	}
+
+	p.named = make(map[string]*Socks5WsProxy)
+	for _, name := range router.Servers() {
+		if p.named[name] != nil {
+			continue
+		}
+		s := p.servers.Endpoint(name)
+		if s == nil {
+			return fmt.Errorf("rules name unknown server %s", name)
+		}
+		p.named[name] = NewSocks5WsProxy(context.Background(), p.servers.EndpointDispatcher(s))
+	}
+
+	p.pool.connect = router.Connection(p.openTunnel, DirectConnection(NewTargetDialer(direct)))
+	return nil
+}
+
+func (p *Profile) openTunnel(ctx context.Context, req *Request, server string) (io.ReadWriteCloser, error) {
+	if len(server) == 0 {
+		return p.pool.openTunnel(ctx, req)
+	}
+	return p.named[server].openTunnel(ctx, req)
+}
+
+func (p *Profile) Close() error {
+	p.pool.Close()
+	for _, s := range p.named {
+		s.Close()
+	}
+	return nil
+}
+
+// checkUser tells whether password is the one of user in its profile, users
+// of no profile are rejected.
+func checkUser(profiles []*Profile, user, password string) bool {
+	for _, p := range profiles {
+		if known, ok := p.Users[user]; ok {
+			return subtle.ConstantTimeCompare([]byte(password), []byte(known)) == 1
+		}
+	}
+	return false
+}
+
+// selectProfile picks the profile of a client of the shared listeners by
+// username first, then by source, the default one otherwise. Socks clients
+// always have a username once profiles have users.
+func selectProfile(profiles []*Profile, peer net.Addr, user string) *Profile {
+	if len(user) > 0 {
+		for _, p := range profiles {
+			if _, ok := p.Users[user]; ok {
+				return p
+			}
+		}
+	}
+	for _, p := range profiles {
+		if p.Sources.Contains(peer) {
+			return p
+		}
+	}
+	return profiles[0]
+}
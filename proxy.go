@@ -4,76 +4,322 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"math"
+	"io"
 	"net"
-	"net/http"
 
 	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 )
 
-func NewClientProxy(listenPort int, wsServerAddr string, ignoreCertificate bool) *ClientProxy {
-	return &ClientProxy{
-		listenPort:        listenPort,
-		serverAddr:        wsServerAddr,
-		ignoreCertificate: ignoreCertificate,
-		wait:              make(chan bool, 1),
+func NewClientProxy(listens []string, allow Allowlist, profiles []*Profile, upstream *UpstreamProxy, tlsConfig *tls.Config) *ClientProxy {
+	c := &ClientProxy{
+		listens:   listens,
+		allow:     allow,
+		profiles:  profiles,
+		upstream:  upstream,
+		tlsConfig: tlsConfig,
+		wait:      make(chan bool, 1),
 	}
+	for _, p := range profiles {
+		c.askUser = c.askUser || len(p.Users) > 0
+	}
+	return c
 }
 
+// ClientProxy serves the local clients through the session pools of its
+// profiles, the first one is the default.
 type ClientProxy struct {
-	listenPort        int
-	serverAddr        string
-	listener          net.Listener
-	proxies           []*Socks5WsProxy
-	ignoreCertificate bool
-	wait              chan bool
+	listens   []string
+	allow     Allowlist
+	profiles  []*Profile
+	askUser   bool
+	upstream  *UpstreamProxy
+	direct    *Resolver
+	fake      *FakeIPPool
+	reverse   *Socks5WsProxy
+	agent     *Socks5WsProxy
+	listeners []net.Listener
+	tlsConfig *tls.Config
+	wait      chan bool
+}
+
+// servers are the servers of the default profile.
+func (c *ClientProxy) servers() *ServerGroup {
+	return c.profiles[0].servers
+}
+
+// endpoints are the servers of all the profiles.
+func (c *ClientProxy) endpoints() []*ServerEndpoint {
+	var endpoints []*ServerEndpoint
+	for _, p := range c.profiles {
+		endpoints = append(endpoints, p.Endpoints...)
+	}
+	return endpoints
 }
 
-func (c *ClientProxy) wsDispatcher() (Dispatcher, error) {
+func (c *ClientProxy) wsDispatcher(ctx context.Context, s *ServerEndpoint, accept bool) (Dispatcher, error) {
+	serverUrl := s.Url
 	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: c.ignoreCertificate,
-		},
+		TLSClientConfig: EndpointTLSConfig(c.tlsConfig, s),
+		Subprotocols:    args.WsSubprotocol,
+	}
+
+	requestHeader, err := WsRequestHeader(s)
+	if err != nil {
+		return nil, err
 	}
 
-	var requestHeader = http.Header{}
-	if len(args.Secret) > 0 {
-		requestHeader.Add(AuthToken, args.Secret)
+	proxy, err := c.upstream.For(serverUrl)
+	if err != nil {
+		return nil, err
+	}
+	if s.via != nil {
+		log.Debugf("client - connect server %s through server %s", serverUrl, s.via.Name)
+		dialer.NetDialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return c.dialVia(ctx, s.via, addr)
+		}
+	} else if proxy != nil {
+		log.Debugf("client - connect server %s through upstream proxy %s", serverUrl, proxy.Redacted())
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialUpstream(ctx, proxy, addr)
+		}
 	}
 
-	wsc, _, err := dialer.Dial(c.serverAddr, requestHeader)
+	wsc, resp, err := dialer.DialContext(ctx, serverUrl, requestHeader)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, fmt.Errorf("%v, server answered %s", err, resp.Status)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	t := NewTransport(NewWebSocket(wsc))
-	d := NewProxyDispatcher(t)
+	d := NewProxyDispatcher(t, accept)
 	return d, nil
 }
 
+func (c *ClientProxy) serveDns() error {
+	d := NewClientDns(c.fake, c.direct, c.DialTunnel, c.endpoints())
+	return NewDnsServer(args.DnsListen, d.Handle).Serve()
+}
+
+func (c *ClientProxy) serveTransparent(addr string, tproxy bool) {
+	t := NewTransparentProxy(addr, tproxy, c)
+	err := t.Serve()
+	log.Errorf("client transparent proxy %s stopped: %v", addr, err)
+}
+
+// serveReverse keeps a session of its own for the reverse forwards, bound
+// again at every connect.
+func (c *ClientProxy) serveReverse() error {
+	forwards, err := LoadForwards(args.Reverse, "")
+	if err != nil {
+		return err
+	}
+	r, err := NewReverseForwards(forwards)
+	if err != nil {
+		return err
+	}
+
+	c.reverse = NewSocks5WsProxy(context.Background(), func() (Dispatcher, error) {
+		d, err := c.servers().AcceptingDispatcher()
+		if err == nil {
+			go r.Serve(d)
+		}
+		return d, err
+	})
+	return nil
+}
+
+// listen opens the listeners of addrs for profile, nil for the shared ones.
+func (c *ClientProxy) listen(addrs []string, profile *Profile) error {
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		l = c.allow.Listener(l)
+		c.listeners = append(c.listeners, l)
+		go c.serveProxy(l, profile)
+	}
+	return nil
+}
+
+func (c *ClientProxy) serveProxy(l net.Listener, profile *Profile) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Errorf("client proxy listener %s stopped: %v", l.Addr(), err)
+			return
+		}
+		go c.accept(conn, profile)
+	}
+}
+
+// accept serves a local client, on the shared listeners its profile is
+// chosen once the request is read.
+func (c *ClientProxy) accept(conn net.Conn, profile *Profile) {
+	bc := NewBufferedConn(conn)
+	ctx := WithFakeIPs(context.Background(), c.fake)
+	var dst, user string
+	if profile == nil && c.askUser {
+		ctx = WithSocksUser(ctx, &user, func(user, password string) bool {
+			return checkUser(c.profiles, user, password)
+		})
+	}
+	connect := func(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+		dst = req.Address()
+		p := profile
+		if p == nil {
+			p = selectProfile(c.profiles, conn.RemoteAddr(), user)
+		}
+		return p.pool.connect(ctx, req)
+	}
+
+	tunnel, err := ProxyHandshake(ctx, bc, connect)
+	if err != nil {
+		log.Errorf("client proxy handshake error: %v", err)
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		bc.Close()
+		return
+	}
+	log.Info("client proxy handshake success")
+	tunnel = activeTunnels.Track(tunnel, dst, conn.RemoteAddr())
+
+	var proxyConnection = NewProxyConnection(tunnel, bc)
+	proxyConnection.TunnelTraffic()
+}
+
+// transparentHandshake tunnels a transparent connection through the
+// profile of its source.
+func (c *ClientProxy) transparentHandshake(conn *BufferedConn, peer net.Addr, dst *net.TCPAddr) (io.ReadWriteCloser, error) {
+	p := selectProfile(c.profiles, peer, "")
+	var address string
+	connect := func(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+		address = req.Address()
+		return p.pool.connect(ctx, req)
+	}
+
+	tunnel, err := TransparentHandshake(WithFakeIPs(context.Background(), c.fake), conn, dst, connect)
+	if err != nil {
+		return tunnel, err
+	}
+	return activeTunnels.Track(tunnel, address, peer), nil
+}
+
 func (c *ClientProxy) Serve() error {
 	var err error
-	listenAddr := fmt.Sprintf(":%d", c.listenPort)
-	c.listener, err = net.Listen("tcp", listenAddr)
+	for _, s := range c.endpoints() {
+		if _, err = WsRequestHeader(s); err != nil {
+			return err
+		}
+	}
+
+	c.direct, err = NewResolver(args.DnsServer, nil, args.DnsCacheSize)
 	if err != nil {
 		return err
 	}
+	// the listeners restore the fake addresses from their first connection
+	if args.FakeIP {
+		c.fake, err = NewFakeIPPool(args.FakeIPv4Range, args.FakeIPv6Range)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range c.profiles {
+		if err = p.start(c); err != nil {
+			return err
+		}
+	}
+
+	if err = c.listen(c.listens, nil); err != nil {
+		return err
+	}
+	for _, p := range c.profiles {
+		if err = c.listen(p.Listen, p); err != nil {
+			return err
+		}
+	}
+
+	if len(args.MetricsListen) > 0 {
+		// a group of all the servers, only for their status
+		ServeMetrics(args.MetricsListen, NewServerGroup(c.endpoints(), nil))
+	}
 
-	clientCount := int(math.Max(float64(args.ClientCount), 1))
-	c.proxies = make([]*Socks5WsProxy, clientCount)
-	for i := 0; i < clientCount; i++ {
-		p := NewSocks5WsProxy(context.Background(), c.wsDispatcher, c.listener)
-		c.proxies[i] = p
-		go p.Serve()
+	if len(args.DnsListen) > 0 {
+		err = c.serveDns()
+		if err != nil {
+			return err
+		}
+	}
+
+	forwards, err := LoadForwards(args.Forward, args.ForwardFile)
+	if err != nil {
+		return err
+	}
+	for _, f := range forwards {
+		err = f.Serve(context.Background(), c.DialTunnel, c.allow)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(args.Reverse) > 0 {
+		err = c.serveReverse()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(args.Agent) > 0 {
+		dialer := NewTargetDialer(c.direct)
+		c.agent = NewSocks5WsProxy(context.Background(), func() (Dispatcher, error) {
+			d, err := c.servers().AcceptingDispatcher()
+			if err == nil {
+				go ServeAgent(d, args.Agent, dialer)
+			}
+			return d, err
+		})
+	}
+
+	if len(args.Control) > 0 {
+		err = c.ServeControl(args.Control)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(args.RedirListen) > 0 {
+		go c.serveTransparent(args.RedirListen, false)
+	}
+	if len(args.TproxyListen) > 0 {
+		go c.serveTransparent(args.TproxyListen, true)
 	}
 	<-c.wait
 	return nil
 }
 
+// DialTunnel connects address from the server through one of the sessions
+// of the default profile.
+func (c *ClientProxy) DialTunnel(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+	return c.profiles[0].pool.DialTunnel(ctx, address)
+}
+
 func (c *ClientProxy) Close() error {
-	for _, p := range c.proxies {
+	for _, p := range c.profiles {
 		p.Close()
 	}
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	if c.reverse != nil {
+		c.reverse.Close()
+	}
+	if c.agent != nil {
+		c.agent.Close()
+	}
 	c.wait <- true
 	return nil
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+	OnlyIPv4   = "ipv4only"
+	OnlyIPv6   = "ipv6only"
+)
+
+const (
+	dnsQueryTimeout    = 5 * time.Second
+	dnsSystemTtl       = 60 * time.Second
+	dnsNegativeTtl     = 30 * time.Second
+	dnsPreferUserLabel = "user:"
+)
+
+var (
+	errDnsTruncated = errors.New("dns response truncated")
+	errDnsNotFound  = errors.New("no such host")
+
+	dnsLatency = NewLatencyHistogram("dns_latency_ms")
+)
+
+type dnsPreferRule struct {
+	user   string
+	suffix string
+	prefer string
+}
+
+// Resolver resolves the targets of the server, with the upstream servers
+// given or the host resolver otherwise, and caches answers by their TTL.
+type Resolver struct {
+	upstreams []*DnsUpstream
+	rules     []dnsPreferRule
+	prefer    string
+	cache     *TTLCache[*DnsAnswer]
+}
+
+// NewResolver takes prefer specs as family, suffix=family or
+// user:name=family, the family being one of ipv4, ipv6, ipv4only, ipv6only.
+func NewResolver(servers, prefers []string, cacheSize int) (*Resolver, error) {
+	r := &Resolver{
+		cache: NewTTLCache[*DnsAnswer](cacheSize),
+	}
+
+	for _, s := range servers {
+		u, err := ParseDnsUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	for _, spec := range prefers {
+		key, family, found := strings.Cut(spec, "=")
+		if !found {
+			key, family = "", spec
+		}
+		family = strings.ToLower(family)
+		switch family {
+		case PreferIPv4, PreferIPv6, OnlyIPv4, OnlyIPv6:
+		default:
+			return nil, fmt.Errorf("dns prefer %s: unknown family %s", spec, family)
+		}
+
+		switch {
+		case len(key) == 0:
+			r.prefer = family
+		case strings.HasPrefix(key, dnsPreferUserLabel):
+			r.rules = append(r.rules, dnsPreferRule{user: key[len(dnsPreferUserLabel):], prefer: family})
+		default:
+			r.rules = append(r.rules, dnsPreferRule{suffix: strings.ToLower(strings.Trim(key, ".")), prefer: family})
+		}
+	}
+	return r, nil
+}
+
+// Prefer returns the family preference for host, user rules win over the
+// longest matching domain suffix.
+func (r *Resolver) Prefer(host, user string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	prefer, matched := r.prefer, -1
+	for _, rule := range r.rules {
+		if len(rule.user) > 0 {
+			if rule.user == user {
+				return rule.prefer
+			}
+			continue
+		}
+		if len(rule.suffix) > matched && (host == rule.suffix || strings.HasSuffix(host, "."+rule.suffix)) {
+			prefer, matched = rule.prefer, len(rule.suffix)
+		}
+	}
+	return prefer
+}
+
+// LookupHost returns the addresses of host, the preferred family first.
+func (r *Resolver) LookupHost(ctx context.Context, host, user string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	prefer := r.Prefer(host, user)
+	var families []dnsmessage.Type
+	switch prefer {
+	case OnlyIPv4:
+		families = []dnsmessage.Type{dnsmessage.TypeA}
+	case OnlyIPv6:
+		families = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case PreferIPv4:
+		families = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	default:
+		families = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		answers = make([][]net.IP, len(families))
+		errs    = make([]error, len(families))
+	)
+	for i, qtype := range families {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			answers[i], errs[i] = r.lookup(ctx, host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	for _, answer := range answers {
+		ips = append(ips, answer...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, &net.DNSError{Err: errDnsNotFound.Error(), Name: host, IsNotFound: true}
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := qtype.String() + " " + strings.ToLower(host)
+	if answer, _, ok := r.cache.Get(key); ok {
+		metrics.Add("dns_cache_hits", 1)
+		if len(answer.IPs) == 0 {
+			metrics.Add("dns_cache_negative_hits", 1)
+		}
+		return answer.IPs, nil
+	}
+	metrics.Add("dns_cache_misses", 1)
+
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	start := time.Now()
+	answer, err := r.query(ctx, host, qtype)
+	dnsLatency.Observe(time.Since(start))
+	if err != nil {
+		metrics.Add("dns_failures", 1)
+		log.Debugf("resolve %s %s failure: %v", qtype, host, err)
+		return nil, err
+	}
+
+	r.cache.Set(key, answer, answer.Ttl)
+	return answer.IPs, nil
+}
+
+func (r *Resolver) query(ctx context.Context, host string, qtype dnsmessage.Type) (*DnsAnswer, error) {
+	if len(r.upstreams) == 0 {
+		return r.querySystem(ctx, host, qtype)
+	}
+
+	query, err := NewDnsQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range r.upstreams {
+		var (
+			resp   []byte
+			answer *DnsAnswer
+		)
+		resp, err = exchangeUpstream(ctx, u, query)
+		if err == nil {
+			answer, err = ParseDnsAnswer(resp, dnsNegativeTtl)
+		}
+		if err != nil {
+			log.Debugf("dns upstream %s failure: %v", u, err)
+			continue
+		}
+		if answer.RCode != dnsmessage.RCodeSuccess && answer.RCode != dnsmessage.RCodeNameError {
+			err = fmt.Errorf("dns upstream %s replied %s", u, answer.RCode)
+			continue
+		}
+		return answer, nil
+	}
+	return nil, err
+}
+
+// Exchange sends a raw query to the upstreams in turn, false when there is
+// no upstream configured.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, bool, error) {
+	if len(r.upstreams) == 0 {
+		return nil, false, nil
+	}
+
+	var err error
+	for _, u := range r.upstreams {
+		var resp []byte
+		resp, err = exchangeUpstream(ctx, u, query)
+		if err != nil {
+			log.Debugf("dns upstream %s failure: %v", u, err)
+			continue
+		}
+		return resp, true, nil
+	}
+	return nil, true, err
+}
+
+// exchangeUpstream retries over tcp when the udp response was truncated.
+func exchangeUpstream(ctx context.Context, u *DnsUpstream, query []byte) ([]byte, error) {
+	resp, err := u.Exchange(ctx, query)
+	if err == nil && u.Network == "udp" && len(resp) > 2 && resp[2]&0x02 != 0 {
+		resp, err = (&DnsUpstream{Network: "tcp", Address: u.Address}).Exchange(ctx, query)
+	}
+	return resp, err
+}
+
+func (r *Resolver) querySystem(ctx context.Context, host string, qtype dnsmessage.Type) (*DnsAnswer, error) {
+	network := "ip4"
+	if qtype == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	var (
+		dnsErr  *net.DNSError
+		addrErr *net.AddrError
+	)
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return &DnsAnswer{RCode: dnsmessage.RCodeNameError, Ttl: dnsNegativeTtl}, nil
+	}
+	if errors.As(err, &addrErr) {
+		// the name exists without addresses of this family
+		return &DnsAnswer{RCode: dnsmessage.RCodeSuccess, Ttl: dnsNegativeTtl}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DnsAnswer{RCode: dnsmessage.RCodeSuccess, IPs: ips, Ttl: dnsSystemTtl}, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReverseAcl is a --reverseallow entry, user:ports with * for any user.
+type ReverseAcl struct {
+	User  string
+	ports [2]uint16
+}
+
+func ParseReverseAcl(spec string) (*ReverseAcl, error) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("reverse allow %s is not user:ports", spec)
+	}
+	ports, err := parsePortRange(spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("reverse allow %s: %v", spec, err)
+	}
+	return &ReverseAcl{User: spec[:i], ports: ports}, nil
+}
+
+func ParseReverseAcls(specs []string) ([]*ReverseAcl, error) {
+	var acls []*ReverseAcl
+	for _, spec := range specs {
+		acl, err := ParseReverseAcl(spec)
+		if err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl)
+	}
+	return acls, nil
+}
+
+// reverseAllowed tells whether user may listen on port, nobody may without
+// --reverseallow.
+func reverseAllowed(acls []*ReverseAcl, user string, port uint16) bool {
+	for _, acl := range acls {
+		if (acl.User == "*" || acl.User == user) && port >= acl.ports[0] && port <= acl.ports[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseListen serves a REVERSE request of the client, the listener lives
+// as long as the tunnel of the request and the session.
+func (w *WsSocks5Proxy) reverseListen(req *Request, logger *log.Entry) (net.Conn, error) {
+	if !reverseAllowed(w.reverseAcls, w.user, req.Port) {
+		logger.Warnf("server - reverse listen on %s not allowed", req.Address())
+		return nil, errRejected
+	}
+
+	l, err := net.Listen("tcp", req.Address())
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("server - reverse listen on %s", l.Addr())
+
+	control := w.control(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Infof("server - reverse listen on %s closed", l.Addr())
+				return
+			}
+			go w.reverseAccept(conn, req.Address(), logger)
+		}
+	}()
+	return &reverseConn{Conn: control, addr: l.Addr()}, nil
+}
+
+// control returns the tunnel end of a request kept open by the client,
+// release runs once the client closes it or the session is down.
+func (w *WsSocks5Proxy) control(release func()) net.Conn {
+	control, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, remote)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-done:
+		case <-w.Done():
+			remote.Close()
+		}
+		release()
+	}()
+	return control
+}
+
+// reverseAccept opens a tunnel to the client for conn, the client knows
+// the target by the address it asked to listen on.
+func (w *WsSocks5Proxy) reverseAccept(conn net.Conn, address string, logger *log.Entry) {
+	req, err := NewRequest(CONNECT, address)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	newConn := func(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+		return w.OpenTunnel(ctx)
+	}
+
+	tunnel, reply, err := TunnelHandshake(w.ctx, req, newConn)
+	if err == nil && reply.CmdOrRep != SUCCEEDED {
+		tunnel.Close()
+		err = fmt.Errorf("client replied with error: %v", reply.CmdOrRep)
+	}
+	if err != nil {
+		logger.Errorf("server - reverse connection from %s to %s: %v", conn.RemoteAddr(), address, err)
+		conn.Close()
+		return
+	}
+	logger.Debugf("server - reverse connection from %s to %s", conn.RemoteAddr(), address)
+
+	NewProxyConnection(tunnel, conn).TunnelTraffic()
+}
+
+// reverseConn is the tunnel end of a reverse listener, its local address
+// is the one listened on.
+type reverseConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *reverseConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func NewReverseForwards(forwards []*LocalForward) (*ReverseForwards, error) {
+	r := &ReverseForwards{targets: make(map[string]string)}
+	for _, f := range forwards {
+		req, err := NewRequest(REVERSE, f.Listen)
+		if err != nil {
+			return nil, err
+		}
+		r.requests = append(r.requests, req)
+		// the server names the listener as it was sent
+		r.targets[req.Address()] = f.Target
+	}
+	return r, nil
+}
+
+// ReverseForwards asks the server to listen for the client, like ssh -R,
+// and connects the tunnels the server opens back to the local targets.
+type ReverseForwards struct {
+	requests []*Request
+	targets  map[string]string
+}
+
+// Serve binds the forwards on a newly connected session d and accepts its
+// tunnels until it is down.
+func (r *ReverseForwards) Serve(d Dispatcher) {
+	ctx, cancel := sessionContext(d)
+	defer cancel()
+
+	newConn := func(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+		return d.OpenTunnel(ctx)
+	}
+	for _, req := range r.requests {
+		// the tunnel is kept open, the server listens as long as it is
+		_, reply, err := TunnelHandshake(ctx, req, newConn)
+		if err != nil {
+			log.Errorf("client - reverse forward %s error: %v", req.Address(), err)
+			continue
+		}
+		if reply.CmdOrRep != SUCCEEDED {
+			log.Errorf("client - reverse forward %s refused by server with error: %v", req.Address(), reply.CmdOrRep)
+			continue
+		}
+		log.Infof("client - server listens on %s for %s", reply.Address(), r.targets[req.Address()])
+	}
+
+	dial := func(ctx context.Context, network string, req *Request) (net.Conn, error) {
+		target, ok := r.targets[req.Address()]
+		if !ok || req.CmdOrRep != CONNECT {
+			return nil, errRejected
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	ServeServerTunnels(ctx, d, dial)
+}
+
+// sessionContext is canceled once the session d is down.
+func sessionContext(d Dispatcher) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// ServeServerTunnels answers the tunnels the server opens on the client
+// side of session d, the roles of the handshake are swapped.
+func ServeServerTunnels(ctx context.Context, d Dispatcher, dial DialTarget) {
+	for {
+		t, err := d.AcceptTunnel(ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			c := NewBufferedConn(t)
+			target, err := ServerHandshake(ctx, c, dial)
+			if err != nil {
+				if target != nil {
+					target.Close()
+				}
+				c.Close()
+				return
+			}
+			NewProxyConnection(c, target).TunnelTraffic()
+		}()
+	}
+}
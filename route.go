@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RuleDomain        = "DOMAIN"
+	RuleDomainSuffix  = "DOMAIN-SUFFIX"
+	RuleDomainKeyword = "DOMAIN-KEYWORD"
+	RuleIPCidr        = "IP-CIDR"
+	RulePort          = "DST-PORT"
+	RuleGeoIP         = "GEOIP"
+	RuleMatch         = "MATCH"
+
+	RouteDirect = "DIRECT"
+	RouteProxy  = "PROXY"
+	RouteReject = "REJECT"
+)
+
+var errRejected = errors.New("rejected by rule")
+
+// Rule is a line of the rules file, TYPE,VALUE,ACTION or MATCH,ACTION, the
+// action is DIRECT, PROXY, PROXY:server or REJECT.
+type Rule struct {
+	Line   int
+	Text   string
+	Type   string
+	Value  string
+	Action string
+	Server string
+
+	prefix netip.Prefix
+	ports  [2]uint16
+}
+
+// default route when no rule matches
+var proxyRule = &Rule{Text: "default", Action: RouteProxy}
+
+func ParseRule(line int, text string) (*Rule, error) {
+	fields := strings.Split(text, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	r := &Rule{Line: line, Text: text, Type: strings.ToUpper(fields[0])}
+	if r.Type == RuleMatch {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("rule line %d: %s takes an action only", line, r.Type)
+		}
+		r.Action = fields[1]
+	} else {
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("rule line %d: %s takes a value and an action", line, r.Type)
+		}
+		r.Value, r.Action = fields[1], fields[2]
+	}
+
+	var err error
+	switch r.Type {
+	case RuleDomain, RuleDomainSuffix, RuleDomainKeyword:
+		r.Value = strings.ToLower(strings.Trim(r.Value, "."))
+	case RuleIPCidr, "IP-CIDR6":
+		r.Type = RuleIPCidr
+		r.prefix, err = netip.ParsePrefix(r.Value)
+		r.prefix = r.prefix.Masked()
+	case RulePort:
+		r.ports, err = parsePortRange(r.Value)
+	case RuleGeoIP:
+		r.Value = strings.ToUpper(r.Value)
+	case RuleMatch:
+	default:
+		err = fmt.Errorf("unknown type %s", r.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule line %d: %v", line, err)
+	}
+
+	action, server, _ := strings.Cut(r.Action, ":")
+	r.Action = strings.ToUpper(action)
+	switch r.Action {
+	case RouteProxy:
+		r.Server = server
+	case RouteDirect, RouteReject:
+		if len(server) > 0 {
+			return nil, fmt.Errorf("rule line %d: %s takes no server", line, r.Action)
+		}
+	default:
+		return nil, fmt.Errorf("rule line %d: unknown action %s", line, r.Action)
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) ([2]uint16, error) {
+	low, high, found := strings.Cut(s, "-")
+	if !found {
+		high = low
+	}
+	first, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return [2]uint16{}, err
+	}
+	last, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return [2]uint16{}, err
+	}
+	if first > last {
+		return [2]uint16{}, fmt.Errorf("port range %s reversed", s)
+	}
+	return [2]uint16{uint16(first), uint16(last)}, nil
+}
+
+// Match tells whether req is for r, ip rules only match destinations given
+// as IP, domains are not resolved for them.
+func (r *Rule) Match(req *Request, geoip *GeoIP) bool {
+	domain := ""
+	if req.Atyp == DOMAIN {
+		domain = strings.ToLower(strings.TrimSuffix(req.Host(), "."))
+	}
+	var ip netip.Addr
+	if addr := req.IPAddress(); addr != nil {
+		ip, _ = netip.AddrFromSlice(addr.IP)
+		ip = ip.Unmap()
+	}
+
+	switch r.Type {
+	case RuleDomain:
+		return domain == r.Value
+	case RuleDomainSuffix:
+		return len(domain) > 0 && matchDomainSuffix(domain, []string{r.Value})
+	case RuleDomainKeyword:
+		return len(domain) > 0 && strings.Contains(domain, r.Value)
+	case RuleIPCidr:
+		return ip.IsValid() && r.prefix.Contains(ip)
+	case RulePort:
+		return req.Port >= r.ports[0] && req.Port <= r.ports[1]
+	case RuleGeoIP:
+		return ip.IsValid() && geoip != nil && geoip.Country(ip) == r.Value
+	case RuleMatch:
+		return true
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	if r.Line == 0 {
+		return r.Text
+	}
+	return fmt.Sprintf("line %d: %s", r.Line, r.Text)
+}
+
+func LoadRouter(rulesPath, geoipPath string) (*Router, error) {
+	router := &Router{}
+	if len(geoipPath) > 0 {
+		var err error
+		router.geoip, err = LoadGeoIP(geoipPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		r, err := ParseRule(line, text)
+		if err != nil {
+			return nil, err
+		}
+		if r.Type == RuleGeoIP && router.geoip == nil {
+			return nil, fmt.Errorf("rule line %d: GEOIP without a geoip database", line)
+		}
+		router.rules = append(router.rules, r)
+	}
+	return router, scanner.Err()
+}
+
+// Router picks the route of every destination by the first matching rule,
+// the tunnel is taken when none matches.
+type Router struct {
+	rules []*Rule
+	geoip *GeoIP
+}
+
+func (router *Router) Match(req *Request) *Rule {
+	for _, r := range router.rules {
+		if r.Match(req, router.geoip) {
+			return r
+		}
+	}
+	return proxyRule
+}
+
+// Servers lists the servers named by the rules.
+func (router *Router) Servers() []string {
+	var servers []string
+	for _, r := range router.rules {
+		if len(r.Server) > 0 {
+			servers = append(servers, r.Server)
+		}
+	}
+	return servers
+}
+
+// OpenConnection is a NewConnection for the route of req, proxy opens a
+// tunnel on the named server or on any with an empty name.
+type OpenConnection = func(ctx context.Context, req *Request, server string) (io.ReadWriteCloser, error)
+
+func (router *Router) Connection(proxy OpenConnection, direct NewConnection) NewConnection {
+	return func(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+		r := router.Match(req)
+		log.Debugf("client - route %s to %s by rule %s", req.Address(), r.Action, r)
+
+		switch r.Action {
+		case RouteReject:
+			return nil, errRejected
+		case RouteDirect:
+			return direct(ctx, req)
+		}
+		return proxy(ctx, req, r.Server)
+	}
+}
+
+// DirectConnection connects without the tunnel, the server side handshake
+// runs locally so the client handshake goes the same for every route.
+func DirectConnection(dialer *TargetDialer) NewConnection {
+	return func(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+		local, remote := net.Pipe()
+		go func() {
+			c := NewBufferedConn(remote)
+			dial := func(ctx context.Context, network string, req *Request) (net.Conn, error) {
+				return dialer.Dial(ctx, network, req, "", log.WithField("direct", req.Address()))
+			}
+			target, err := ServerHandshake(ctx, c, dial)
+			if err != nil {
+				if target != nil {
+					target.Close()
+				}
+				c.Close()
+				return
+			}
+			NewProxyConnection(c, target).TunnelTraffic()
+		}()
+		return local, nil
+	}
+}
+
+type geoipEntry struct {
+	prefix  netip.Prefix
+	country string
+}
+
+// LoadGeoIP reads a csv of network,country_code lines, other lines such as
+// a header are skipped.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &GeoIP{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 2 {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+		g.entries = append(g.entries, geoipEntry{prefix.Masked(), strings.ToUpper(strings.TrimSpace(fields[1]))})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(g.entries, func(i, j int) bool {
+		return g.entries[i].prefix.Addr().Less(g.entries[j].prefix.Addr())
+	})
+	return g, nil
+}
+
+// GeoIP maps addresses to countries, networks are not expected to overlap.
+type GeoIP struct {
+	entries []geoipEntry
+}
+
+func (g *GeoIP) Country(ip netip.Addr) string {
+	i := sort.Search(len(g.entries), func(i int) bool {
+		return ip.Less(g.entries[i].prefix.Addr())
+	})
+	if i > 0 && g.entries[i-1].prefix.Contains(ip) {
+		return g.entries[i-1].country
+	}
+	return ""
+}
+
+// TestRoutes prints the route of every destination, for checking the rules.
+func TestRoutes(w io.Writer, router *Router, destinations []string) error {
+	for _, dst := range destinations {
+		req, err := NewRequest(CONNECT, dst)
+		if err != nil {
+			return err
+		}
+		r := router.Match(req)
+		action := r.Action
+		if len(r.Server) > 0 {
+			action += ":" + r.Server
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", dst, action, r)
+	}
+	return nil
+}
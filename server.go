@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 )
 
 func NewServer(listenUrl string) *Server {
@@ -24,6 +25,7 @@ func NewServer(listenUrl string) *Server {
 			CheckOrigin: func(_ *http.Request) bool {
 				return true
 			},
+			Subprotocols: args.WsSubprotocol,
 		},
 	}
 }
@@ -31,14 +33,62 @@ func NewServer(listenUrl string) *Server {
 type Server struct {
 	listenUrl string
 	ws        *websocket.Upgrader
+	dialer    *TargetDialer
+	reverse   []*ReverseAcl
+	agents    *Agents
 }
 
 func (s *Server) Serve() error {
+	r, err := NewResolver(args.DnsServer, args.DnsPrefer, args.DnsCacheSize)
+	if err != nil {
+		return err
+	}
+	s.dialer = NewTargetDialer(r)
+
+	s.reverse, err = ParseReverseAcls(args.ReverseAllow)
+	if err != nil {
+		return err
+	}
+	if len(args.AgentListen) > 0 {
+		acls, err := ParseAgentAcls(args.AgentAllow)
+		if err != nil {
+			return err
+		}
+		s.agents = NewAgents(acls)
+	}
+	for _, spec := range args.AgentListen {
+		l, err := ParseAgentListener(spec)
+		if err != nil {
+			return err
+		}
+		l.Password = args.AgentPassword
+		if err = l.Serve(s.agents); err != nil {
+			return err
+		}
+	}
+
+	if len(args.MetricsListen) > 0 {
+		ServeMetrics(args.MetricsListen, nil)
+	}
 	return s.RunWs()
 }
 
-func (s *Server) RegisterWs(path string, mux *http.ServeMux) {
-	mux.HandleFunc(path, s.wsAccept)
+func (s *Server) RegisterWs(route *WsRoute, mux *http.ServeMux) error {
+	if route.dialer == nil {
+		route.dialer = s.dialer
+		if len(route.DnsServer) > 0 || len(route.DnsPrefer) > 0 {
+			r, err := NewResolver(route.DnsServer, route.DnsPrefer, args.DnsCacheSize)
+			if err != nil {
+				return fmt.Errorf("route %s: %v", route.Pattern, err)
+			}
+			route.dialer = NewTargetDialer(r)
+		}
+	}
+
+	mux.HandleFunc(route.Pattern, func(w http.ResponseWriter, r *http.Request) {
+		s.wsAccept(route, w, r)
+	})
+	return nil
 }
 
 func (s *Server) RunWs() error {
@@ -63,15 +113,35 @@ func (s *Server) RunWs() error {
 	}
 
 	hs := http.NewServeMux()
-	s.RegisterWs(u.Path, hs)
+	routes := []*WsRoute{{Pattern: u.Path, Secret: args.Secret, dialer: s.dialer}}
+	for _, spec := range args.WsRoute {
+		route, err := ParseWsRoute(spec, u.Path)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, route)
+	}
+	patterns := make(map[string]bool)
+	for _, route := range routes {
+		if patterns[route.Pattern] {
+			return fmt.Errorf("route %s given twice", route.Pattern)
+		}
+		patterns[route.Pattern] = true
+		if err = s.RegisterWs(route, hs); err != nil {
+			return err
+		}
+	}
 
 	if tlsEnabled {
-		cert, err := GenX509KeyPair(u.Hostname())
+		cert, err := s.certificate(u.Hostname())
 		if err != nil {
 			return err
 		}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		config, err := ServerTLSConfig(cert)
+		if err != nil {
+			return err
+		}
 		srv := &http.Server{
 			Addr:      port,
 			Handler:   hs,
@@ -80,13 +150,35 @@ func (s *Server) RunWs() error {
 		return srv.ListenAndServeTLS("", "")
 	}
 
+	if len(args.TlsClientCa) > 0 {
+		return fmt.Errorf("--tlsclientca needs a wss url")
+	}
 	return http.ListenAndServe(port, hs)
 }
 
-func (s *Server) wsAccept(w http.ResponseWriter, r *http.Request) {
-	if len(args.Secret) > 0 {
+// certificate loads the pair of --tlscert and --tlskey, a self-signed one is
+// generated without them.
+func (s *Server) certificate(domain string) (tls.Certificate, error) {
+	if len(args.TlsCert) > 0 || len(args.TlsKey) > 0 {
+		return tls.LoadX509KeyPair(args.TlsCert, args.TlsKey)
+	}
+
+	cert, err := GenX509KeyPair(domain)
+	if err != nil {
+		return cert, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+	log.Warnf("server - self-signed certificate generated, clients need --insecure --tlspin %s", SPKIPin(leaf))
+	return cert, nil
+}
+
+func (s *Server) wsAccept(route *WsRoute, w http.ResponseWriter, r *http.Request) {
+	if len(route.Secret) > 0 {
 		secret := r.Header.Get(AuthToken)
-		if !strings.EqualFold(secret, args.Secret) {
+		if !strings.EqualFold(secret, route.Secret) {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("Auth Failure!"))
 			return
@@ -98,9 +190,16 @@ func (s *Server) wsAccept(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var user string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		user = ClientIdentity(r.TLS.PeerCertificates[0])
+	}
+	log.Infof("server - session of user %q from %s on route %s", user, r.RemoteAddr, route.Pattern)
+	log.Debugf("server - session request host %s, user agent %q, origin %q, subprotocol %q", r.Host, r.UserAgent(), r.Header.Get("Origin"), wsc.Subprotocol())
+
 	var rwc = NewWebSocket(wsc)
 	var t = NewTransport(rwc)
-	p := NewWsSocks5Proxy(context.Background(), NewProxyDispatcher(t))
+	p := NewWsSocks5Proxy(context.Background(), NewServerDispatcher(t), route.dialer, user, s.reverse, s.agents)
 	go p.Serve()
 }
 
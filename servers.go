@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseServerEndpoint parses url[,priority=N][,weight=N][,name=NAME]
+// [,sni=NAME][,pin=sha256/BASE64][,host=HOST][,secret=TOKEN][,via=NAME]
+// [,exit=BOOL], a lower priority is preferred and servers of the same
+// priority share the load by weight.
+func ParseServerEndpoint(spec string) (*ServerEndpoint, error) {
+	fields := strings.Split(spec, ",")
+	s := &ServerEndpoint{
+		Url:     strings.TrimSpace(fields[0]),
+		Weight:  1,
+		healthy: true,
+	}
+
+	u, err := url.Parse(s.Url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("server %s is not a websocket url", s.Url)
+	}
+	s.Name = u.Host
+
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return nil, fmt.Errorf("server %s option %s has no value", s.Url, field)
+		}
+		switch key {
+		case "priority":
+			s.Priority, err = strconv.Atoi(value)
+		case "weight":
+			s.Weight, err = strconv.Atoi(value)
+			if err == nil && s.Weight < 1 {
+				err = fmt.Errorf("weight %d less than 1", s.Weight)
+			}
+		case "name":
+			s.Name = value
+		case "sni":
+			s.ServerName = value
+		case "pin":
+			value, err = ParseSPKIPin(value)
+			s.Pins = append(s.Pins, value)
+		case "host":
+			s.Host = value
+		case "secret":
+			s.Secret = value
+		case "via":
+			s.Via = value
+		case "exit":
+			s.Exit, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %v", s.Url, err)
+		}
+	}
+	return s, nil
+}
+
+// ParseServerEndpoints takes the plain server url, if any, and the server
+// specs.
+func ParseServerEndpoints(serverUrl string, specs []string) ([]*ServerEndpoint, error) {
+	if len(serverUrl) > 0 {
+		specs = append([]string{serverUrl}, specs...)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no server given")
+	}
+
+	var endpoints []*ServerEndpoint
+	for _, spec := range specs {
+		s, err := ParseServerEndpoint(spec)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, s)
+	}
+	return endpoints, nil
+}
+
+type ServerEndpoint struct {
+	sync.Mutex
+	Name     string
+	Url      string
+	Priority int
+	Weight   int
+	// options over the ones of the flags
+	ServerName string
+	Pins       []string
+	Host       string
+	Secret     string
+	// Via names the server relaying the connections to this one, Exit lets
+	// a relay take sessions of its own too
+	Via  string
+	Exit bool
+
+	via         *ServerEndpoint
+	relay       bool
+	healthy     bool
+	err         error
+	rtt         time.Duration
+	checked     time.Time
+	failures    int
+	dispatchers []Dispatcher
+}
+
+func (s *ServerEndpoint) Healthy() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.healthy
+}
+
+func (s *ServerEndpoint) markUp(rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.healthy {
+		log.Warnf("client - server %s is up", s.Name)
+	}
+	s.healthy = true
+	s.failures = 0
+	s.err = nil
+	s.rtt = rtt
+	s.checked = time.Now()
+}
+
+// markDown keeps new sessions off s, the ones connected stay.
+func (s *ServerEndpoint) markDown(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.healthy {
+		log.Errorf("client - server %s is down: %v", s.Name, err)
+	}
+	s.healthy = false
+	s.err = err
+	s.checked = time.Now()
+}
+
+// probeFailed marks s down and closes its sessions once downAfter probes
+// failed in a row, their tunnels move to another server when they
+// reconnect.
+func (s *ServerEndpoint) probeFailed(err error) {
+	s.markDown(err)
+
+	s.Lock()
+	defer s.Unlock()
+	s.failures++
+	if s.failures < downAfter {
+		return
+	}
+	for _, d := range s.dispatchers {
+		d.Close()
+	}
+	s.dispatchers = nil
+}
+
+// hasDispatcher tells whether d is a session connected to s.
+func (s *ServerEndpoint) hasDispatcher(d Dispatcher) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, known := range s.dispatchers {
+		if known == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerEndpoint) addDispatcher(d Dispatcher) {
+	s.Lock()
+	defer s.Unlock()
+
+	alive := s.dispatchers[:0]
+	for _, old := range s.dispatchers {
+		if old.IsAlive() {
+			alive = append(alive, old)
+		}
+	}
+	s.dispatchers = append(alive, d)
+}
+
+type serverStatus struct {
+	Name     string  `json:"name"`
+	Url      string  `json:"url"`
+	Priority int     `json:"priority"`
+	Weight   int     `json:"weight"`
+	Healthy  bool    `json:"healthy"`
+	Sessions int     `json:"sessions"`
+	RttMs    float64 `json:"rtt_ms"`
+	Checked  string  `json:"checked,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func (s *ServerEndpoint) status() serverStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	st := serverStatus{
+		Name:     s.Name,
+		Url:      s.Url,
+		Priority: s.Priority,
+		Weight:   s.Weight,
+		Healthy:  s.healthy,
+		RttMs:    float64(s.rtt) / float64(time.Millisecond),
+	}
+	for _, d := range s.dispatchers {
+		if d.IsAlive() {
+			st.Sessions++
+		}
+	}
+	if !s.checked.IsZero() {
+		st.Checked = s.checked.Format(time.RFC3339)
+	}
+	if s.err != nil {
+		st.Error = s.err.Error()
+	}
+	return st
+}
+
+// downAfter is the count of probes failed in a row closing the sessions
+// of a server.
+const downAfter = 3
+
+// DialServer connects a session to s, accept lets the server open tunnels
+// on it.
+type DialServer = func(ctx context.Context, s *ServerEndpoint, accept bool) (Dispatcher, error)
+
+func NewServerGroup(endpoints []*ServerEndpoint, dial DialServer) *ServerGroup {
+	return &ServerGroup{
+		endpoints: endpoints,
+		dial:      dial,
+	}
+}
+
+// ServerGroup connects sessions to the preferred healthy server, failing
+// over by priority.
+type ServerGroup struct {
+	endpoints []*ServerEndpoint
+	dial      DialServer
+}
+
+// candidates orders the healthy servers by priority, shuffled by weight
+// within a priority, the unhealthy ones come last as a final resort. Relays
+// are left out unless they are exits too.
+func (g *ServerGroup) candidates() []*ServerEndpoint {
+	var healthy, unhealthy []*ServerEndpoint
+	for _, s := range g.endpoints {
+		if s.relay && !s.Exit {
+			continue
+		}
+		if s.Healthy() {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+
+	healthy = weightedShuffle(healthy)
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return healthy[i].Priority < healthy[j].Priority
+	})
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].Priority < unhealthy[j].Priority
+	})
+	return append(healthy, unhealthy...)
+}
+
+func weightedShuffle(endpoints []*ServerEndpoint) []*ServerEndpoint {
+	var total int
+	for _, s := range endpoints {
+		total += s.Weight
+	}
+
+	rest := append([]*ServerEndpoint(nil), endpoints...)
+	shuffled := make([]*ServerEndpoint, 0, len(endpoints))
+	for len(rest) > 0 {
+		n := rand.Intn(total)
+		i := 0
+		for n >= rest[i].Weight {
+			n -= rest[i].Weight
+			i++
+		}
+		shuffled = append(shuffled, rest[i])
+		total -= rest[i].Weight
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return shuffled
+}
+
+// Dispatcher connects a session to the first server of the candidates that
+// accepts it.
+func (g *ServerGroup) Dispatcher() (Dispatcher, error) {
+	return g.dispatcher(false)
+}
+
+// AcceptingDispatcher connects a session the server opens tunnels on, like
+// Dispatcher does.
+func (g *ServerGroup) AcceptingDispatcher() (Dispatcher, error) {
+	return g.dispatcher(true)
+}
+
+func (g *ServerGroup) dispatcher(accept bool) (Dispatcher, error) {
+	var err error
+	for _, s := range g.candidates() {
+		var d Dispatcher
+		d, err = g.connect(s, accept)
+		if err == nil {
+			return d, nil
+		}
+	}
+	return nil, err
+}
+
+func (g *ServerGroup) connect(s *ServerEndpoint, accept bool) (Dispatcher, error) {
+	d, err := g.dial(context.Background(), s, accept)
+	if err != nil {
+		s.markDown(err)
+		return nil, err
+	}
+	log.Infof("client - session connected to server %s", s.Name)
+	s.addDispatcher(d)
+	return d, nil
+}
+
+func (g *ServerGroup) Endpoint(name string) *ServerEndpoint {
+	for _, s := range g.endpoints {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// EndpointDispatcher returns the NewDispatcher of sessions bound to the
+// server s.
+func (g *ServerGroup) EndpointDispatcher(s *ServerEndpoint) NewDispatcher {
+	return func() (Dispatcher, error) {
+		return g.connect(s, false)
+	}
+}
+
+// HealthCheck probes every server each interval, until ctx is done. No
+// interval disables the probes.
+func (g *ServerGroup) HealthCheck(ctx context.Context, interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, s := range g.endpoints {
+			go g.check(ctx, s, timeout)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *ServerGroup) check(ctx context.Context, s *ServerEndpoint, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := g.probe(ctx, s)
+	if err != nil {
+		s.probeFailed(err)
+		return
+	}
+	rtt := time.Since(start)
+	log.Debugf("client - server %s health check passed in %v", s.Name, rtt)
+	s.markUp(rtt)
+}
+
+// probe connects s and negotiates the method of a test tunnel.
+func (g *ServerGroup) probe(ctx context.Context, s *ServerEndpoint) error {
+	d, err := g.dial(ctx, s, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	t, err := d.OpenTunnel(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	c := NewBufferedConn(t)
+	methodRequest := &MethodRequest{Socks5Version, 1, []uint8{NOAUTH}}
+	_, err = c.Write(methodRequest.Encode())
+	if err != nil {
+		return err
+	}
+	_, err = ReadMethodReply(c.Reader())
+	return err
+}
+
+// EndpointOf returns the server the session d is connected to.
+func (g *ServerGroup) EndpointOf(d Dispatcher) *ServerEndpoint {
+	for _, s := range g.endpoints {
+		if s.hasDispatcher(d) {
+			return s
+		}
+	}
+	return nil
+}
+
+// ServeHTTP writes the state of the servers as json.
+func (g *ServerGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var servers []serverStatus
+	for _, s := range g.endpoints {
+		servers = append(servers, s.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SniffAnnotate = "annotate"
+	SniffOverride = "override"
+)
+
+// server-first protocols send nothing, do not hold them any longer
+const sniffTimeout = 300 * time.Millisecond
+
+func sniffEnabled() bool {
+	return args.Sniff == SniffAnnotate || args.Sniff == SniffOverride
+}
+
+type deadlineSetter interface {
+	SetReadDeadline(time.Time) error
+}
+
+// SniffDomain looks at the first bytes sent by the client for a TLS SNI or
+// an HTTP Host, the bytes stay in c for the tunnel.
+func SniffDomain(c *BufferedConn) string {
+	if d, ok := c.ReadWriteCloser.(deadlineSetter); ok {
+		d.SetReadDeadline(time.Now().Add(sniffTimeout))
+		defer d.SetReadDeadline(time.Time{})
+	}
+
+	b, err := c.Peek(1)
+	if err != nil {
+		return ""
+	}
+
+	if b[0] == 0x16 {
+		// peek the whole record when the hello comes in several segments
+		if b, err = c.Peek(5); err != nil {
+			return ""
+		}
+		n := 5 + int(binary.BigEndian.Uint16(b[3:]))
+		b, _ = c.Peek(min(n, c.Reader().Size()))
+		return SniffTLSServerName(b)
+	}
+
+	b, _ = c.Peek(c.Reader().Buffered())
+	return SniffHTTPHost(b)
+}
+
+// SniffRequest returns req with the sniffed domain as destination in the
+// override mode, the annotate mode only logs it.
+func SniffRequest(c *BufferedConn, req *Request) *Request {
+	domain := SniffDomain(c)
+	if len(domain) == 0 {
+		return req
+	}
+
+	log.Infof("client - sniffed domain %s for %s", domain, req.Address())
+	if args.Sniff != SniffOverride {
+		return req
+	}
+
+	sniffed, err := NewRequest(req.CmdOrRep, net.JoinHostPort(domain, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		return req
+	}
+	return sniffed
+}
+
+func SniffTLSServerName(b []byte) string {
+	// record header
+	if len(b) < 5 || b[0] != 0x16 {
+		return ""
+	}
+	b = b[5:]
+
+	// handshake header, then client_version and random
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok { // session_id
+		return ""
+	}
+	if b, ok = skipVector(b, 2); !ok { // cipher_suites
+		return ""
+	}
+	if b, ok = skipVector(b, 1); !ok { // compression_methods
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	extensions := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions)
+		n := int(binary.BigEndian.Uint16(extensions[2:]))
+		extensions = extensions[4:]
+		if n > len(extensions) {
+			return ""
+		}
+		if typ == 0x0000 {
+			return parseServerNameExtension(extensions[:n])
+		}
+		extensions = extensions[n:]
+	}
+	return ""
+}
+
+func skipVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	n := int(b[0])
+	if lenBytes == 2 {
+		n = int(binary.BigEndian.Uint16(b))
+	}
+	if len(b) < lenBytes+n {
+		return nil, false
+	}
+	return b[lenBytes+n:], true
+}
+
+func parseServerNameExtension(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 3 {
+		typ := b[0]
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		if n > len(b) {
+			return ""
+		}
+		if typ == 0x00 {
+			return validDomain(string(b[:n]))
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+func SniffHTTPHost(b []byte) string {
+	if len(b) == 0 || !isHTTPMethodStart(b[0]) {
+		return ""
+	}
+	if end := bytes.Index(b, []byte("\r\n\r\n")); end >= 0 {
+		b = b[:end]
+	}
+
+	lines := strings.Split(string(b), "\r\n")
+	if len(lines) < 2 || !strings.Contains(lines[0], " HTTP/1.") {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validDomain(host)
+	}
+	return ""
+}
+
+// validDomain drops IP literals and anything that can not be a hostname.
+func validDomain(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 255 || net.ParseIP(host) != nil {
+		return ""
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return ""
+		}
+	}
+	return host
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const Socks4Version byte = 0x04
+
+const (
+	GRANTED   byte = 0x5A
+	REJECTED  byte = 0x5B
+	NOIDENTD  byte = 0x5C
+	IDENTFAIL byte = 0x5D
+)
+
+// Socks4Request covers both SOCKS4 and SOCKS4a, the latter carries the
+// destination as a domain after the userid when IP is 0.0.0.x (x != 0).
+type Socks4Request struct {
+	Ver    uint8
+	Cmd    uint8
+	Port   uint16
+	IP     net.IP
+	UserId string
+	Domain string
+}
+
+func (r *Socks4Request) Address() string {
+	host := r.Domain
+	if len(host) == 0 {
+		host = r.IP.String()
+	}
+	return fmt.Sprintf("%s:%d", host, r.Port)
+}
+
+// Request maps the SOCKS4 request onto the SOCKS5 one sent through the tunnel.
+func (r *Socks4Request) Request() *Request {
+	req := &Request{
+		Ver:      Socks5Version,
+		CmdOrRep: r.Cmd,
+		Port:     r.Port,
+	}
+	if len(r.Domain) > 0 {
+		req.Atyp = DOMAIN
+		req.Addr = append([]byte{byte(len(r.Domain))}, r.Domain...)
+	} else {
+		req.Atyp = IPV4
+		req.Addr = r.IP.To4()
+	}
+	return req
+}
+
+func isSocks4a(ip net.IP) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+func ParseSocks4Request(data []byte) (*Socks4Request, error) {
+	if len(data) < 9 {
+		return nil, errors.New("socks4 request need more data")
+	}
+	if data[0] != Socks4Version {
+		return nil, ErrVersionMismatch
+	}
+
+	r := &Socks4Request{
+		Ver:  data[0],
+		Cmd:  data[1],
+		Port: binary.BigEndian.Uint16(data[2:]),
+		IP:   net.IP(data[4:8]),
+	}
+
+	end := bytes.IndexByte(data[8:], 0x00)
+	if end < 0 {
+		return nil, errors.New("socks4 userid not terminated")
+	}
+	r.UserId = string(data[8 : 8+end])
+
+	if isSocks4a(r.IP) {
+		rest := data[8+end+1:]
+		end = bytes.IndexByte(rest, 0x00)
+		if end < 0 {
+			return nil, errors.New("socks4a domain not terminated")
+		}
+		if end == 0 || end > 255 {
+			return nil, errors.New("socks4a domain length invalid")
+		}
+		r.Domain = string(rest[:end])
+	}
+	return r, nil
+}
+
+type Socks4Reply struct {
+	Code uint8
+	Port uint16
+	IP   net.IP
+}
+
+func (r *Socks4Reply) Encode() []byte {
+	buffer := []byte{0x00, r.Code}
+	buffer = binary.BigEndian.AppendUint16(buffer, r.Port)
+	ip := r.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	return append(buffer, ip...)
+}
+
+// SendSocks4Reply translates a SOCKS5 reply code into the SOCKS4 one, only
+// an IPv4 bound address fits in the reply.
+func SendSocks4Reply(w io.Writer, rep byte, bound net.Addr) error {
+	reply := &Socks4Reply{Code: REJECTED}
+	if rep == SUCCEEDED {
+		reply.Code = GRANTED
+	}
+	if ip, port := splitNetAddr(bound); ip.To4() != nil {
+		reply.IP = ip
+		reply.Port = port
+	}
+	_, err := w.Write(reply.Encode())
+	return err
+}
+
+// socks4 userid and 4a domain are each bounded to keep peeks in the buffer
+const socks4FieldMax = 256
+
+func socks4RequestSize(b []byte) (int, error) {
+	if b[0] != Socks4Version {
+		return 0, ErrVersionMismatch
+	}
+	if len(b) < 9 {
+		return 9, nil
+	}
+
+	end := bytes.IndexByte(b[8:], 0x00)
+	if end < 0 {
+		if len(b)-8 > socks4FieldMax {
+			return 0, errors.New("socks4 userid too long")
+		}
+		return len(b) + 1, nil
+	}
+	size := 8 + end + 1
+	if !isSocks4a(net.IP(b[4:8])) {
+		return size, nil
+	}
+
+	end = bytes.IndexByte(b[size:], 0x00)
+	if end < 0 {
+		if len(b)-size > socks4FieldMax {
+			return 0, errors.New("socks4a domain too long")
+		}
+		return len(b) + 1, nil
+	}
+	return size + end + 1, nil
+}
+
+func ReadSocks4Request(r *bufio.Reader) (*Socks4Request, error) {
+	data, err := readMessage(r, socks4RequestSize)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSocks4Request(data)
+}
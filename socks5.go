@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 )
 
 const Socks5Version byte = 0x05
@@ -19,6 +22,12 @@ const (
 	CONNECT byte = 0x01
 	BIND    byte = 0x02
 	UDP     byte = 0x03
+	// private to wssocks5, the server listens on the address and opens
+	// the tunnels of the connections back to the client
+	REVERSE byte = 0x80
+	// private too, the client registers as an agent whose network the
+	// agent listeners of the server reach
+	AGENT byte = 0x81
 )
 
 const (
@@ -100,6 +109,13 @@ func (m *message) IPAddress() *net.IPAddr {
 	return &net.IPAddr{IP: m.Addr}
 }
 
+func (m *message) Host() string {
+	if m.Atyp == DOMAIN {
+		return m.Domain()
+	}
+	return m.IPAddress().String()
+}
+
 func (m *message) Address() string {
 	var addr string
 	switch m.Atyp {
@@ -113,10 +129,48 @@ func (m *message) Address() string {
 	return fmt.Sprintf("%s:%d", addr, m.Port)
 }
 
+// NetAddr is the IP endpoint of the message, nil for a domain.
+func (m *message) NetAddr() net.Addr {
+	ip := m.IPAddress()
+	if ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip.IP, Port: int(m.Port)}
+}
+
 type Request = message
 
 type Reply = message
 
+func splitNetAddr(addr net.Addr) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	return nil, 0
+}
+
+func NewReply(rep byte, bound net.Addr) *Reply {
+	reply := &Reply{
+		Ver:      Socks5Version,
+		CmdOrRep: rep,
+		Atyp:     IPV4,
+		Addr:     net.IPv4zero.To4(),
+	}
+
+	ip, port := splitNetAddr(bound)
+	if ip4 := ip.To4(); ip4 != nil {
+		reply.Addr = ip4
+	} else if ip16 := ip.To16(); ip16 != nil {
+		reply.Atyp = IPV6
+		reply.Addr = ip16
+	}
+	reply.Port = port
+	return reply
+}
+
 func ParseMethodRequest(data []byte) (*MethodRequest, error) {
 	if len(data) < 3 {
 		return nil, errors.New("method request need more data")
@@ -197,3 +251,165 @@ func ParseRequest(data []byte) (*Request, error) {
 func ParseReply(data []byte) (*Reply, error) {
 	return parseMessage(data)
 }
+
+// NewRequest builds a socks5 request for a host:port address.
+func NewRequest(cmd byte, address string) (*Request, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+
+	req := &Request{
+		Ver:      Socks5Version,
+		CmdOrRep: cmd,
+		Port:     uint16(port),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req.Atyp = IPV4
+			req.Addr = ip4
+		} else {
+			req.Atyp = IPV6
+			req.Addr = ip.To16()
+		}
+		return req, nil
+	}
+
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+	req.Atyp = DOMAIN
+	req.Addr = append([]byte{byte(len(host))}, host...)
+	return req, nil
+}
+
+// readMessage reads exactly one message off r, sizeOf tells the full length
+// of the message from the bytes seen so far, a length beyond them asks for
+// more. Bytes after the message are left in r.
+func readMessage(r *bufio.Reader, sizeOf func([]byte) (int, error)) ([]byte, error) {
+	need := 1
+	for {
+		b, err := r.Peek(max(need, r.Buffered()))
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := sizeOf(b)
+		if err != nil {
+			return nil, err
+		}
+
+		if n <= len(b) {
+			data := make([]byte, n)
+			_, err = io.ReadFull(r, data)
+			return data, err
+		}
+		need = n
+	}
+}
+
+func methodRequestSize(b []byte) (int, error) {
+	if b[0] != Socks5Version {
+		return 0, ErrVersionMismatch
+	}
+	if len(b) < 2 {
+		return 2, nil
+	}
+	if b[1] == 0 {
+		return 0, ErrMethodsMismatch
+	}
+	return 2 + int(b[1]), nil
+}
+
+func methodReplySize(b []byte) (int, error) {
+	return 2, nil
+}
+
+func messageSize(b []byte) (int, error) {
+	if b[0] != Socks5Version {
+		return 0, ErrVersionMismatch
+	}
+	if len(b) < 4 {
+		return 4, nil
+	}
+	if b[2] != 0x00 {
+		return 0, ErrReservedField
+	}
+
+	switch b[3] {
+	case IPV4:
+		return 4 + net.IPv4len + 2, nil
+	case IPV6:
+		return 4 + net.IPv6len + 2, nil
+	case DOMAIN:
+		if len(b) < 5 {
+			return 5, nil
+		}
+		return 4 + 1 + int(b[4]) + 2, nil
+	}
+	return 0, ErrInvalidAtyp
+}
+
+func ReadMethodRequest(r *bufio.Reader) (*MethodRequest, error) {
+	data, err := readMessage(r, methodRequestSize)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMethodRequest(data)
+}
+
+func ReadMethodReply(r *bufio.Reader) (*MethodReply, error) {
+	data, err := readMessage(r, methodReplySize)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMethodReply(data)
+}
+
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	data, err := readMessage(r, messageSize)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRequest(data)
+}
+
+func ReadReply(r *bufio.Reader) (*Reply, error) {
+	data, err := readMessage(r, messageSize)
+	if err != nil {
+		return nil, err
+	}
+	return ParseReply(data)
+}
+
+// readUserPassword reads the RFC 1929 subnegotiation.
+func readUserPassword(c *BufferedConn) (string, string, error) {
+	r := c.Reader()
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", "", err
+	}
+	if header[0] != upasswVersion {
+		return "", "", fmt.Errorf("username/password version %d unknown", header[0])
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(r, username)
+	if err != nil {
+		return "", "", err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	password := make([]byte, n)
+	_, err = io.ReadFull(r, password)
+	if err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
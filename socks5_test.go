@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	methodNoAuth = []byte{Socks5Version, 1, NOAUTH}
+	requestIPv4  = []byte{Socks5Version, CONNECT, 0, IPV4, 10, 0, 0, 1, 0, 80}
+	requestIPv6  = append([]byte{Socks5Version, CONNECT, 0, IPV6}, append(make([]byte, 16), 1, 187)...)
+	requestHost  = append([]byte{Socks5Version, CONNECT, 0, DOMAIN, 11}, append([]byte("example.com"), 1, 187)...)
+	payload      = []byte("GET / HTTP/1.1\r\n\r\n")
+)
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// splitReaders feed data whole, split at every byte and one byte at a time.
+func splitReaders(data []byte) map[string]func() io.Reader {
+	readers := map[string]func() io.Reader{
+		"whole": func() io.Reader { return bytes.NewReader(data) },
+		"bytes": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) },
+	}
+	for i := 1; i < len(data); i++ {
+		i := i
+		readers[fmt.Sprintf("split@%d", i)] = func() io.Reader {
+			return io.MultiReader(bytes.NewReader(data[:i]), bytes.NewReader(data[i:]))
+		}
+	}
+	return readers
+}
+
+// checkRead reads one message with read off every split of data, it must
+// agree with parse on the bytes consumed and leave the rest in the reader.
+func checkRead[T any](t *testing.T, data []byte, read func(*bufio.Reader) (T, error), parse func([]byte) (T, error), equal func(a, b T) bool) {
+	var (
+		first    T
+		firstErr error
+		consumed = -1
+	)
+	for name, newReader := range splitReaders(data) {
+		r := bufio.NewReader(newReader())
+		m, err := read(r)
+		rest, restErr := io.ReadAll(r)
+		if restErr != nil {
+			t.Fatalf("%s: read rest: %v", name, restErr)
+		}
+
+		if consumed < 0 {
+			first, firstErr, consumed = m, err, len(data)-len(rest)
+		}
+		if (err == nil) != (firstErr == nil) {
+			t.Fatalf("%s: error %v, whole read got %v", name, err, firstErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !equal(m, first) {
+			t.Fatalf("%s: read %+v, whole read got %+v", name, m, first)
+		}
+		n := len(data) - len(rest)
+		if n != consumed || !bytes.Equal(rest, data[n:]) {
+			t.Fatalf("%s: consumed %d bytes, whole read %d", name, n, consumed)
+		}
+	}
+	if firstErr != nil {
+		if _, err := parse(data); err == nil {
+			t.Fatalf("parse of the whole %d bytes passed, read failed: %v", len(data), firstErr)
+		}
+		return
+	}
+
+	parsed, err := parse(data[:consumed])
+	if err != nil {
+		t.Fatalf("read %+v but parse of the %d bytes failed: %v", first, consumed, err)
+	}
+	if !equal(parsed, first) {
+		t.Fatalf("read %+v, parse got %+v", first, parsed)
+	}
+}
+
+func equalMethodRequest(a, b *MethodRequest) bool {
+	return a.Ver == b.Ver && a.NMethods == b.NMethods && bytes.Equal(a.Methods, b.Methods)
+}
+
+func equalRequest(a, b *Request) bool {
+	return a.Ver == b.Ver && a.CmdOrRep == b.CmdOrRep && a.Rsv == b.Rsv && a.Atyp == b.Atyp &&
+		bytes.Equal(a.Addr, b.Addr) && a.Port == b.Port
+}
+
+func FuzzReadMethodRequest(f *testing.F) {
+	f.Add(methodNoAuth)
+	f.Add([]byte{Socks5Version, 2, NOAUTH, UPASSW})
+	f.Add([]byte{Socks5Version, 0})
+	f.Add([]byte{4, 1, 0})
+	f.Add([]byte{Socks5Version, 3, NOAUTH})
+	f.Add(concat(methodNoAuth, requestIPv4, payload))
+	f.Add(concat(methodNoAuth, requestHost, payload))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRead(t, data, ReadMethodRequest, ParseMethodRequest, equalMethodRequest)
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add(requestIPv4)
+	f.Add(requestIPv6)
+	f.Add(requestHost)
+	f.Add([]byte{Socks5Version, CONNECT, 0, DOMAIN, 0, 0, 80})
+	f.Add([]byte{Socks5Version, CONNECT, 1, IPV4, 10, 0, 0, 1, 0, 80})
+	f.Add([]byte{Socks5Version, CONNECT, 0, 9, 10, 0, 0, 1, 0, 80})
+	f.Add(requestHost[:8])
+	f.Add(concat(requestIPv6, payload))
+	f.Add(concat(requestHost, payload))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRead(t, data, ReadRequest, ParseRequest, equalRequest)
+	})
+}
+
+// TestReadPipelined reads the method request, the request and the payload
+// sent in one write, split at every byte.
+func TestReadPipelined(t *testing.T) {
+	for _, request := range [][]byte{requestIPv4, requestIPv6, requestHost} {
+		data := concat(methodNoAuth, request, payload)
+		for name, newReader := range splitReaders(data) {
+			r := bufio.NewReader(newReader())
+			if _, err := ReadMethodRequest(r); err != nil {
+				t.Fatalf("%s: method request: %v", name, err)
+			}
+			req, err := ReadRequest(r)
+			if err != nil {
+				t.Fatalf("%s: request: %v", name, err)
+			}
+			if !bytes.Equal(req.Encode(), request) {
+				t.Fatalf("%s: request %v, sent %v", name, req.Encode(), request)
+			}
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, payload) {
+				t.Fatalf("%s: payload %q left, sent %q", name, rest, payload)
+			}
+		}
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"net"
+	"math/rand/v2"
 	"sync"
 	"time"
 
@@ -12,91 +13,192 @@ import (
 
 type NewDispatcher = func() (Dispatcher, error)
 
-func NewSocks5WsProxy(ctx context.Context, newDispatcher NewDispatcher, l net.Listener) *Socks5WsProxy {
-	d, err := newDispatcher()
-	if err != nil {
-		panic(err)
-	}
+// rttWeight is the weight of a new sample in the smoothed rtt
+const rttWeight = 0.2
 
+func NewSocks5WsProxy(ctx context.Context, newDispatcher NewDispatcher) *Socks5WsProxy {
 	ctx, cancel := context.WithCancel(ctx)
-	return &Socks5WsProxy{
-		Mutex:            &sync.Mutex{},
-		Dispatcher:       d,
-		Listener:         l,
+	p := &Socks5WsProxy{
 		ctx:              ctx,
 		cancel:           cancel,
 		createDispatcher: newDispatcher,
 	}
+	go p.run()
+	return p
 }
 
+// Socks5WsProxy is a session of the client, a WebSocket connection to the
+// server carrying tunnels, kept connected in the background.
 type Socks5WsProxy struct {
-	*sync.Mutex
-	Dispatcher
-	net.Listener
+	sync.Mutex
+	dispatcher       Dispatcher
 	ctx              context.Context
 	cancel           context.CancelFunc
 	createDispatcher NewDispatcher
-	reconnect        int
+	rtt              time.Duration
+	rttLock          sync.Mutex
+	// connects counts the successful connects, since is the last one
+	connects int
+	since    time.Time
+}
+
+// stableSession is how long a session stays up before its reconnects back
+// off from the start again.
+const stableSession = 30 * time.Second
+
+// CheckReconnectDelays rejects delays which would make sessions reconnect
+// in a busy loop.
+func CheckReconnectDelays(delay, maxDelay time.Duration) error {
+	if delay <= 0 {
+		return fmt.Errorf("reconnect delay %v is not positive", delay)
+	}
+	if maxDelay < delay {
+		return fmt.Errorf("reconnect max delay %v is less than the delay %v", maxDelay, delay)
+	}
+	return nil
+}
+
+// reconnectDelay returns the wait before the next attempt, a random one
+// between half and all of backoff.
+func reconnectDelay(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + rand.N(backoff/2+1)
 }
 
-func (p *Socks5WsProxy) Serve() error {
+// run connects the session and reconnects it once down. Failed attempts and
+// sessions dropped before being stable back off exponentially up to the
+// maximum.
+func (p *Socks5WsProxy) run() {
+	backoff := args.ReconnectDelay
 	for {
-		conn, err := p.Accept()
+		d, err := p.createDispatcher()
 		if err != nil {
-			return err
+			delay := reconnectDelay(backoff)
+			log.Errorf("client - session connect failure, retry in %v: %v", delay, err)
+			if !p.sleep(delay) {
+				return
+			}
+			backoff = min(backoff*2, args.ReconnectMaxDelay)
+			continue
+		}
+
+		connected := time.Now()
+		p.Lock()
+		p.dispatcher = d
+		p.connects++
+		p.since = connected
+		p.Unlock()
+
+		select {
+		case <-d.Done():
+		case <-p.ctx.Done():
+			d.Close()
+			return
+		}
+
+		if time.Since(connected) >= stableSession {
+			backoff = args.ReconnectDelay
+		}
+		delay := reconnectDelay(backoff)
+		log.Warnf("client - session disconnected, reconnecting in %v", delay)
+		if !p.sleep(delay) {
+			return
 		}
-		go p.accept(conn)
+		backoff = min(backoff*2, args.ReconnectMaxDelay)
+	}
+}
+
+// sleep waits for delay, false when the session is closed meanwhile.
+func (p *Socks5WsProxy) sleep(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-p.ctx.Done():
+		return false
 	}
 }
 
+func (p *Socks5WsProxy) current() Dispatcher {
+	p.Lock()
+	defer p.Unlock()
+	return p.dispatcher
+}
+
 func (p *Socks5WsProxy) Close() error {
 	p.cancel()
-	p.Dispatcher.Close()
-	return p.Listener.Close()
+	if d := p.current(); d != nil {
+		return d.Close()
+	}
+	return nil
 }
 
-func (p *Socks5WsProxy) accept(conn net.Conn) {
-	tunnel, err := p.handshake(conn)
-	if err != nil {
-		log.Errorf("client socks5 handshake error: %v", err)
-		if tunnel != nil {
-			tunnel.Close()
-		}
-		conn.Close()
-		return
+// Ready tells whether the session is connected.
+func (p *Socks5WsProxy) Ready() bool {
+	d := p.current()
+	return d != nil && d.IsAlive()
+}
+
+func (p *Socks5WsProxy) TunnelCount() int {
+	if d := p.current(); d != nil {
+		return d.TunnelCount()
 	}
-	log.Info("client socks5 handshake success")
+	return 0
+}
 
-	var proxyConnection = NewProxyConnection(tunnel, conn)
-	proxyConnection.TunnelTraffic()
+// Rtt is the smoothed round trip of the method negotiations on the session,
+// zero before the first tunnel.
+func (p *Socks5WsProxy) Rtt() time.Duration {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+	return p.rtt
 }
 
-func (p *Socks5WsProxy) handshake(conn net.Conn) (s io.ReadWriteCloser, err error) {
-	if !p.Dispatcher.IsAlive() {
-		err = func() error {
-			p.Lock()
-			defer p.Unlock()
-			if p.reconnect >= 3 {
-				time.Sleep(8 * time.Second)
-			}
+func (p *Socks5WsProxy) observeRtt(rtt time.Duration) {
+	p.rttLock.Lock()
+	defer p.rttLock.Unlock()
+	if p.rtt == 0 {
+		p.rtt = rtt
+		return
+	}
+	p.rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(p.rtt))
+}
 
-			d, err := p.createDispatcher()
-			if err != nil {
-				p.reconnect += 1
-				return err
-			}
-			p.reconnect = 0
-			p.Dispatcher = d
-			return nil
-		}()
-		if err != nil {
-			return
-		}
+func (p *Socks5WsProxy) openTunnel(ctx context.Context, req *Request) (io.ReadWriteCloser, error) {
+	d := p.current()
+	if d == nil || !d.IsAlive() {
+		return nil, errNoSession
 	}
 
-	newConn := func(ctx context.Context) (io.ReadWriteCloser, error) {
-		return p.OpenTunnel(ctx)
+	t, err := d.OpenTunnel(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return &rttConn{ReadWriteCloser: t, observe: p.observeRtt}, nil
+}
 
-	return ProxyHandshake(p.ctx, conn, newConn)
+// rttConn times the first write to the first read of a tunnel, the server
+// answers the method request right away.
+type rttConn struct {
+	io.ReadWriteCloser
+	observe func(time.Duration)
+	start   time.Time
+	done    bool
+}
+
+func (c *rttConn) Write(b []byte) (int, error) {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+func (c *rttConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if !c.done && n > 0 && !c.start.IsZero() {
+		c.done = true
+		c.observe(time.Since(c.start))
+	}
+	return n, err
 }
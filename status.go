@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// activeTunnels are the tunnels of the local clients, shown on the control
+// socket.
+var activeTunnels = NewTunnelTable()
+
+func NewTunnelTable() *TunnelTable {
+	return &TunnelTable{tunnels: make(map[uint64]*trackedTunnel)}
+}
+
+type TunnelTable struct {
+	sync.Mutex
+	next    uint64
+	tunnels map[uint64]*trackedTunnel
+}
+
+// Track counts the traffic of tunnel until it is closed.
+func (t *TunnelTable) Track(tunnel io.ReadWriteCloser, dst string, peer net.Addr) io.ReadWriteCloser {
+	tracked := &trackedTunnel{
+		ReadWriteCloser: tunnel,
+		table:           t,
+		dst:             dst,
+		started:         time.Now(),
+	}
+	if peer != nil {
+		tracked.peer = peer.String()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.next++
+	tracked.id = t.next
+	t.tunnels[tracked.id] = tracked
+	return tracked
+}
+
+func (t *TunnelTable) remove(id uint64) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.tunnels, id)
+}
+
+func (t *TunnelTable) status() []tunnelStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	var tunnels []tunnelStatus
+	for _, tracked := range t.tunnels {
+		tunnels = append(tunnels, tunnelStatus{
+			Id:          tracked.id,
+			Destination: tracked.dst,
+			Peer:        tracked.peer,
+			Sent:        tracked.sent.Load(),
+			Received:    tracked.received.Load(),
+			AgeS:        time.Since(tracked.started).Seconds(),
+		})
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Id < tunnels[j].Id
+	})
+	return tunnels
+}
+
+type trackedTunnel struct {
+	io.ReadWriteCloser
+	table    *TunnelTable
+	id       uint64
+	dst      string
+	peer     string
+	started  time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	once     sync.Once
+}
+
+func (t *trackedTunnel) Read(b []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(b)
+	t.received.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedTunnel) Write(b []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(b)
+	t.sent.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedTunnel) Close() error {
+	t.once.Do(func() {
+		t.table.remove(t.id)
+	})
+	return t.ReadWriteCloser.Close()
+}
+
+type tunnelStatus struct {
+	Id          uint64  `json:"id"`
+	Destination string  `json:"destination"`
+	Peer        string  `json:"peer"`
+	Sent        int64   `json:"sent"`
+	Received    int64   `json:"received"`
+	AgeS        float64 `json:"age_s"`
+}
+
+type sessionStatus struct {
+	Name       string  `json:"name"`
+	Server     string  `json:"server"`
+	State      string  `json:"state"`
+	RttMs      float64 `json:"rtt_ms"`
+	Reconnects int     `json:"reconnects"`
+	Tunnels    int     `json:"tunnels"`
+	Since      string  `json:"since,omitempty"`
+}
+
+type controlStatus struct {
+	Sessions []sessionStatus `json:"sessions"`
+	Tunnels  []tunnelStatus  `json:"tunnels"`
+	Servers  []serverStatus  `json:"servers"`
+}
+
+func (p *Socks5WsProxy) status(name string, servers *ServerGroup) sessionStatus {
+	p.Lock()
+	d, connects, since := p.dispatcher, p.connects, p.since
+	p.Unlock()
+
+	st := sessionStatus{
+		Name:       name,
+		State:      "connecting",
+		RttMs:      float64(p.Rtt()) / float64(time.Millisecond),
+		Reconnects: max(connects-1, 0),
+	}
+	if d == nil {
+		return st
+	}
+	st.State = "reconnecting"
+	if d.IsAlive() {
+		st.State = "up"
+		st.Tunnels = d.TunnelCount()
+		st.Since = since.Format(time.RFC3339)
+	}
+	if s := servers.EndpointOf(d); s != nil {
+		st.Server = s.Name
+	}
+	return st
+}
+
+// ServeControl serves the status of the client as JSON on /status over the
+// unix socket path, only the user may connect.
+func (c *ClientProxy) ServeControl(path string) error {
+	// a socket left by a previous run would fail the listen
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.status())
+	})
+	go func() {
+		err := http.Serve(l, mux)
+		log.Errorf("control socket %s stopped: %v", path, err)
+	}()
+	return nil
+}
+
+// listenPrivate listens on the unix socket path for the user only, the
+// socket is made in a directory of the user and moved to path once its mode
+// is set so nobody may connect before.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".wssocks5-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "control.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is not there anymore once moved
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *ClientProxy) status() controlStatus {
+	st := controlStatus{Tunnels: activeTunnels.status()}
+	for _, p := range c.profiles {
+		// sessions of the other profiles are named after them
+		prefix := ""
+		if p.Name != defaultProfile {
+			prefix = p.Name + "/"
+		}
+		for i, s := range p.pool.sessions {
+			st.Sessions = append(st.Sessions, s.status(fmt.Sprintf("%spool#%d", prefix, i), p.servers))
+		}
+		var names []string
+		for name := range p.named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			st.Sessions = append(st.Sessions, p.named[name].status(prefix+"rules:"+name, p.servers))
+		}
+		for _, s := range p.Endpoints {
+			st.Servers = append(st.Servers, s.status())
+		}
+	}
+	if c.reverse != nil {
+		st.Sessions = append(st.Sessions, c.reverse.status("reverse", c.servers()))
+	}
+	if c.agent != nil {
+		st.Sessions = append(st.Sessions, c.agent.status("agent:"+args.Agent, c.servers()))
+	}
+	return st
+}
+
+// ShowStatus prints the status of the client of the control socket path,
+// again every watch when not zero.
+func ShowStatus(w io.Writer, path string, watch time.Duration) error {
+	if len(path) == 0 {
+		return fmt.Errorf("no control socket, give --control")
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	for {
+		st, err := fetchStatus(client)
+		if err != nil {
+			return fmt.Errorf("control socket %s: %v", path, err)
+		}
+		if watch > 0 {
+			// clear the terminal
+			fmt.Fprint(w, "\033[H\033[2J")
+			fmt.Fprintf(w, "%s\n\n", time.Now().Format(time.DateTime))
+		}
+		renderStatus(w, st)
+		if watch <= 0 {
+			return nil
+		}
+		time.Sleep(watch)
+	}
+}
+
+func fetchStatus(client *http.Client) (*controlStatus, error) {
+	resp, err := client.Get("http://control/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	st := &controlStatus{}
+	return st, json.NewDecoder(resp.Body).Decode(st)
+}
+
+func renderStatus(w io.Writer, st *controlStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tSERVER\tSTATE\tRTT\tRECONNECTS\tTUNNELS\tSINCE")
+	for _, s := range st.Sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1fms\t%d\t%d\t%s\n", s.Name, s.Server, s.State, s.RttMs, s.Reconnects, s.Tunnels, s.Since)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "TUNNEL\tDESTINATION\tPEER\tSENT\tRECEIVED\tAGE")
+	for _, t := range st.Tunnels {
+		age := time.Duration(t.AgeS * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%v\n", t.Id, t.Destination, t.Peer, formatBytes(t.Sent), formatBytes(t.Received), age)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "SERVER\tURL\tHEALTHY\tSESSIONS\tRTT\tERROR")
+	for _, s := range st.Servers {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%d\t%.1fms\t%s\n", s.Name, s.Url, s.Healthy, s.Sessions, s.RttMs, s.Error)
+	}
+	tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", value), ".0") + string(units[unit]) + "B"
+}
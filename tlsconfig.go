@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const pinPrefix = "sha256/"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("tls version %s unknown, use 1.0 to 1.3", version)
+	}
+	return v, nil
+}
+
+// SPKIPin is the sha256/base64 fingerprint of the public key of cert.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParseSPKIPin accepts sha256/BASE64 or the bare BASE64 of a sha256 digest.
+func ParseSPKIPin(pin string) (string, error) {
+	digest := strings.TrimPrefix(pin, pinPrefix)
+	b, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("pin %s is not a base64 sha256 digest", pin)
+	}
+	return pinPrefix + digest, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	certs, err := LoadCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return certs, nil
+}
+
+// ClientTLSConfig builds the tls config to the servers from the flags,
+// the chain is verified unless --insecure and the pins are always checked.
+func ClientTLSConfig(servers []*ServerEndpoint) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         args.TlsServerName,
+		InsecureSkipVerify: args.Insecure,
+	}
+
+	var err error
+	config.MinVersion, err = ParseTLSVersion(args.TlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.TlsCa) > 0 {
+		config.RootCAs, err = LoadCertPool(args.TlsCa)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args.TlsClientCert) > 0 || len(args.TlsClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(args.TlsClientCert, args.TlsClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	pins, err := parseSPKIPins(args.TlsPin)
+	if err != nil {
+		return nil, err
+	}
+	config.VerifyConnection = verifySPKIPins(pins)
+
+	if args.Insecure {
+		for _, server := range servers {
+			if len(pins) == 0 && len(server.Pins) == 0 {
+				log.Errorf("client - TLS verification of server %s is DISABLED by --insecure, anyone on the path can impersonate it", server.Name)
+			} else {
+				log.Warnf("client - TLS chain verification of server %s disabled by --insecure, only the pinned keys are checked", server.Name)
+			}
+		}
+	}
+	return config, nil
+}
+
+// ServerTLSConfig serves cert, client certificates are required when a
+// client ca is given and checked against the crl.
+func ServerTLSConfig(cert tls.Certificate) (*tls.Config, error) {
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(args.TlsClientCa) == 0 {
+		if len(args.TlsCrl) > 0 {
+			return nil, fmt.Errorf("--tlscrl needs --tlsclientca")
+		}
+		return config, nil
+	}
+
+	if args.TlsIdentity != "subject" && args.TlsIdentity != "san" {
+		return nil, fmt.Errorf("tls identity %s unknown, use subject or san", args.TlsIdentity)
+	}
+
+	cas, err := LoadCertificates(args.TlsClientCa)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	for _, ca := range cas {
+		config.ClientCAs.AddCert(ca)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(args.TlsCrl) > 0 {
+		crl, err := LoadCRL(args.TlsCrl, cas)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			leaf := cs.PeerCertificates[0]
+			if crl.Revoked(leaf) {
+				log.Errorf("server - revoked certificate of %s rejected", ClientIdentity(leaf))
+				return fmt.Errorf("certificate %s revoked", leaf.SerialNumber)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// ClientIdentity names the owner of a client certificate by the subject
+// common name, or by its first email, DNS or URI SAN with --tlsidentity san.
+func ClientIdentity(cert *x509.Certificate) string {
+	if args.TlsIdentity == "san" {
+		switch {
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// EndpointTLSConfig adds the options of the server s to the client config.
+func EndpointTLSConfig(config *tls.Config, s *ServerEndpoint) *tls.Config {
+	if len(s.ServerName) == 0 && len(s.Pins) == 0 {
+		return config
+	}
+
+	config = config.Clone()
+	if len(s.ServerName) > 0 {
+		config.ServerName = s.ServerName
+	}
+	if len(s.Pins) > 0 {
+		config.VerifyConnection = verifySPKIPins(s.Pins)
+	}
+	return config
+}
+
+func parseSPKIPins(pins []string) ([]string, error) {
+	var parsed []string
+	for _, pin := range pins {
+		p, err := ParseSPKIPin(pin)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// verifySPKIPins wants one of the pins in the verified chains, or on the
+// leaf when the chain is not verified.
+func verifySPKIPins(pins []string) func(tls.ConnectionState) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	return func(cs tls.ConnectionState) error {
+		certs := []*x509.Certificate{cs.PeerCertificates[0]}
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		for _, cert := range certs {
+			pin := SPKIPin(cert)
+			for _, want := range pins {
+				if pin == want {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("certificate of %s matches no pin, its key is %s", cs.ServerName, SPKIPin(cs.PeerCertificates[0]))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNotTCP = errors.New("not a tcp connection")
+
+// OriginalDst recovers where a transparently proxied connection was headed.
+type OriginalDst = func(conn net.Conn) (*net.TCPAddr, error)
+
+// tproxyOriginalDst is the local address, TPROXY keeps the destination
+// on the accepted socket itself.
+func tproxyOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errNotTCP
+	}
+	return addr, nil
+}
+
+// the lookups of the original destination, tests stub them
+var (
+	redirectLookup OriginalDst = redirectOriginalDst
+	tproxyLookup   OriginalDst = tproxyOriginalDst
+)
+
+func NewTransparentProxy(addr string, tproxy bool, c *ClientProxy) *TransparentProxy {
+	t := &TransparentProxy{
+		addr:        addr,
+		tproxy:      tproxy,
+		client:      c,
+		originalDst: redirectLookup,
+	}
+	if tproxy {
+		t.originalDst = tproxyLookup
+	}
+	return t
+}
+
+// TransparentProxy accepts iptables REDIRECT or TPROXY connections and
+// tunnels them to their original destination.
+type TransparentProxy struct {
+	addr        string
+	tproxy      bool
+	client      *ClientProxy
+	listener    net.Listener
+	originalDst OriginalDst
+}
+
+func (t *TransparentProxy) Serve() error {
+	l, err := listenTransparent(t.addr, t.tproxy)
+	if err != nil {
+		return err
+	}
+	t.listener = t.client.allow.Listener(l)
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go t.accept(conn)
+	}
+}
+
+func (t *TransparentProxy) Close() error {
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
+func (t *TransparentProxy) accept(conn net.Conn) {
+	dst, err := t.originalDst(conn)
+	if err != nil {
+		log.Errorf("client transparent original destination error: %v", err)
+		conn.Close()
+		return
+	}
+
+	// a connection to the listener itself was not redirected, tunneling it
+	// back here would loop
+	if local, ok := t.listener.Addr().(*net.TCPAddr); ok && dst.Port == local.Port && (dst.IP.Equal(local.IP) || local.IP.IsUnspecified() && dst.IP.IsLoopback()) {
+		log.Errorf("client transparent connection from %s not redirected", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	c := NewBufferedConn(conn)
+	tunnel, err := t.client.transparentHandshake(c, conn.RemoteAddr(), dst)
+	if err != nil {
+		log.Errorf("client transparent handshake error: %v", err)
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		conn.Close()
+		return
+	}
+
+	var proxyConnection = NewProxyConnection(tunnel, c)
+	proxyConnection.TunnelTraffic()
+}
+
+// TransparentHandshake tunnels c to dst, the client expects no reply so a
+// failure only closes the connection.
+func TransparentHandshake(ctx context.Context, c *BufferedConn, dst *net.TCPAddr, newConn NewConnection) (s io.ReadWriteCloser, err error) {
+	var (
+		req   *Request
+		reply *Reply
+		phase = initPhase
+	)
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "[transparent handshake] error on phase: %s", phase)
+			return
+		}
+	}()
+
+	req, err = NewRequest(CONNECT, dst.String())
+	if err != nil {
+		return
+	}
+
+	req, err = fakeIPsOf(ctx).Restore(req)
+	if err != nil {
+		phase = restoreFakeIP
+		return
+	}
+	if sniffEnabled() && req.Atyp != DOMAIN {
+		req = SniffRequest(c, req)
+	}
+
+	log.Debugf("client - try to tunnel transparent connection to address %s", req.Address())
+
+	s, reply, err = TunnelHandshake(ctx, req, newConn)
+	if err != nil {
+		phase = tunnelHandshake
+		return
+	}
+
+	if reply.CmdOrRep != SUCCEEDED {
+		phase = failureSocks5Reply
+		err = fmt.Errorf("socks5 Reply with error: %v", reply.CmdOrRep)
+	}
+	return
+}
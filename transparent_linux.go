@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// netfilter keeps the destination before REDIRECT under this option, on
+// both SOL_IP and SOL_IPV6
+const soOriginalDst = 80
+
+func redirectOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errNotTCP
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := tc.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var (
+		dst     *net.TCPAddr
+		sockErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 has the size of ip6_mtuinfo's address
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if sockErr == nil {
+				// the port is kept in network byte order
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			}
+			return
+		}
+
+		// sockaddr_in fits in the 16 bytes address of ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if sockErr == nil {
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			dst = &net.TCPAddr{IP: net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]), Port: int(port)}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					return
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+
+func redirectOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
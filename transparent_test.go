@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubServer answers the tunnels like the server does and echoes the data,
+// requests gets the address of each tunnel.
+type stubServer struct {
+	requests chan string
+}
+
+func (s *stubServer) connect(ctx context.Context, _ *Request) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	go func() {
+		dial := func(ctx context.Context, network string, req *Request) (net.Conn, error) {
+			s.requests <- req.Address()
+			echo, remote := net.Pipe()
+			go func() {
+				io.Copy(remote, remote)
+				remote.Close()
+			}()
+			return echo, nil
+		}
+		c := NewBufferedConn(server)
+		target, err := ServerHandshake(ctx, c, dial)
+		if err != nil {
+			server.Close()
+			return
+		}
+		NewProxyConnection(target, c).TunnelTraffic()
+	}()
+	return client, nil
+}
+
+// acceptTransparent serves one connection of a transparent proxy whose
+// lookup answers dst and err, and returns the local end.
+func acceptTransparent(t *testing.T, dst *net.TCPAddr, err error) (net.Conn, *stubServer) {
+	server := &stubServer{requests: make(chan string, 1)}
+	pool := &SessionPool{connect: server.connect}
+	client := &ClientProxy{profiles: []*Profile{{Name: defaultProfile, pool: pool}}}
+
+	lookup := redirectLookup
+	redirectLookup = func(net.Conn) (*net.TCPAddr, error) {
+		return dst, err
+	}
+	p := NewTransparentProxy("127.0.0.1:0", false, client)
+	redirectLookup = lookup
+
+	l, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	t.Cleanup(func() { l.Close() })
+	p.listener = l
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			p.accept(conn)
+		}
+	}()
+	conn, dialErr := net.Dial("tcp", l.Addr().String())
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, server
+}
+
+func TestTransparentAccept(t *testing.T) {
+	for _, dst := range []*net.TCPAddr{
+		{IP: net.ParseIP("203.0.113.7"), Port: 443},
+		{IP: net.ParseIP("2001:db8::7"), Port: 8443},
+	} {
+		conn, server := acceptTransparent(t, dst, nil)
+
+		// the application speaks its own protocol, no socks handshake
+		payload := []byte("GET / HTTP/1.1\r\n\r\n")
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("%v: write: %v", dst, err)
+		}
+		select {
+		case address := <-server.requests:
+			if address != dst.String() {
+				t.Fatalf("tunnel to %s, the original destination is %v", address, dst)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: no tunnel opened", dst)
+		}
+
+		echo := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			t.Fatalf("%v: read: %v", dst, err)
+		}
+		if string(echo) != string(payload) {
+			t.Fatalf("%v: echo %q, sent %q", dst, echo, payload)
+		}
+	}
+}
+
+func TestTransparentLookupFailure(t *testing.T) {
+	conn, server := acceptTransparent(t, nil, errors.New("no original destination"))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection kept open without an original destination")
+	}
+	select {
+	case address := <-server.requests:
+		t.Fatalf("tunnel opened to %s", address)
+	default:
+	}
+}
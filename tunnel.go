@@ -48,6 +48,11 @@ type Dispatcher interface {
 
 	IsAlive() bool
 
+	// Done is closed once the dispatcher is closed.
+	Done() <-chan struct{}
+
+	TunnelCount() int
+
 	OpenTunnel(context.Context) (Tunnel, error)
 
 	AcceptTunnel(context.Context) (Tunnel, error)
@@ -60,6 +65,8 @@ type Dispatcher interface {
 type Tunnel interface {
 	io.ReadWriteCloser
 
+	Id() uint16
+
 	ReadOut() ([]byte, error)
 }
 
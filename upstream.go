@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// socks5 username/password subnegotiation, RFC 1929
+const (
+	upasswVersion byte = 0x01
+	upasswSuccess byte = 0x00
+)
+
+func NewUpstreamProxy(proxyUrl string, fromEnv bool) (*UpstreamProxy, error) {
+	p := &UpstreamProxy{}
+	if len(proxyUrl) > 0 {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s: %v", proxyUrl, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("upstream proxy %s: scheme %s not supported, use http, https or socks5", u.Redacted(), u.Scheme)
+		}
+		if len(u.Port()) == 0 {
+			return nil, fmt.Errorf("upstream proxy %s: no port given", u.Redacted())
+		}
+		p.fixed = u
+	} else if fromEnv {
+		p.env = httpproxy.FromEnvironment().ProxyFunc()
+	}
+	return p, nil
+}
+
+// UpstreamProxy chooses the proxy to reach the servers by, a fixed one or
+// the one of HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+type UpstreamProxy struct {
+	fixed *url.URL
+	env   func(*url.URL) (*url.URL, error)
+}
+
+// For returns the proxy to serverUrl, nil to connect directly.
+func (p *UpstreamProxy) For(serverUrl string) (*url.URL, error) {
+	if p.fixed != nil || p.env == nil {
+		return p.fixed, nil
+	}
+
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return nil, err
+	}
+	// the environment names proxies by the http schemes
+	target := *u
+	target.Scheme = "https"
+	if u.Scheme == "ws" {
+		target.Scheme = "http"
+	}
+	return p.env(&target)
+}
+
+// DialUpstream connects addr through the proxy, errors tell which step of
+// the proxy failed.
+func DialUpstream(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy %s unreachable: %v", proxy.Redacted(), err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, proxy, addr)
+	case "https":
+		tc := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		conn = tc
+		if err = tc.HandshakeContext(ctx); err != nil {
+			err = fmt.Errorf("tls handshake: %v", err)
+			break
+		}
+		err = httpConnect(conn, proxy, addr)
+	default:
+		err = httpConnect(conn, proxy, addr)
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %v", proxy.Redacted(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	r := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		r.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	err := r.Write(conn)
+	if err != nil {
+		return fmt.Errorf("write CONNECT %s: %v", addr, err)
+	}
+
+	// nothing comes after the response before the tunnel is used, the
+	// buffered reader holds no data of it
+	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
+	if err != nil {
+		return fmt.Errorf("read CONNECT %s response: %v", addr, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired && proxy.User == nil:
+		return fmt.Errorf("CONNECT %s needs credentials, give them as user:password@ in the proxy url", addr)
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return fmt.Errorf("CONNECT %s credentials of user %s rejected", addr, proxy.User.Username())
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("CONNECT %s answered %s", addr, resp.Status)
+	}
+	return nil
+}
+
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	c := NewBufferedConn(conn)
+	methods := []uint8{NOAUTH}
+	if proxy.User != nil {
+		methods = []uint8{NOAUTH, UPASSW}
+	}
+	methodRequest := &MethodRequest{Socks5Version, uint8(len(methods)), methods}
+	_, err := c.Write(methodRequest.Encode())
+	if err != nil {
+		return fmt.Errorf("write method request: %v", err)
+	}
+
+	methodReply, err := ReadMethodReply(c.Reader())
+	if err != nil {
+		return fmt.Errorf("read method reply: %v", err)
+	}
+	switch methodReply.Method {
+	case NOAUTH:
+	case UPASSW:
+		if err = socks5Authenticate(c, proxy.User); err != nil {
+			return err
+		}
+	case NOACPT:
+		if proxy.User == nil {
+			return fmt.Errorf("no acceptable method, the proxy may need user:password@ in the proxy url")
+		}
+		return fmt.Errorf("no acceptable method")
+	default:
+		return fmt.Errorf("method 0x%02x not supported", methodReply.Method)
+	}
+
+	req, err := NewRequest(CONNECT, addr)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(req.Encode())
+	if err != nil {
+		return fmt.Errorf("write request: %v", err)
+	}
+	reply, err := ReadReply(c.Reader())
+	if err != nil {
+		return fmt.Errorf("read reply: %v", err)
+	}
+	if reply.CmdOrRep != SUCCEEDED {
+		return fmt.Errorf("connect %s replied with error: %v", addr, reply.CmdOrRep)
+	}
+	return nil
+}
+
+func socks5Authenticate(c *BufferedConn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("username or password longer than 255 bytes")
+	}
+
+	b := []byte{upasswVersion, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	_, err := c.Write(b)
+	if err != nil {
+		return fmt.Errorf("write credentials: %v", err)
+	}
+
+	status := make([]byte, 2)
+	_, err = io.ReadFull(c.Reader(), status)
+	if err != nil {
+		return fmt.Errorf("read authentication status: %v", err)
+	}
+	if status[1] != upasswSuccess {
+		return fmt.Errorf("credentials of user %s rejected", username)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WsRequestHeader is the header of the WebSocket dial to s, a Host entry
+// replaces the host of the url in the request only.
+func WsRequestHeader(s *ServerEndpoint) (http.Header, error) {
+	header := http.Header{}
+	for _, h := range args.WsHeader {
+		name, value, found := strings.Cut(h, ":")
+		if !found || len(strings.TrimSpace(name)) == 0 {
+			return nil, fmt.Errorf("header %q is not Name: value", h)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if len(args.WsHost) > 0 {
+		header.Set("Host", args.WsHost)
+	}
+	if len(s.Host) > 0 {
+		header.Set("Host", s.Host)
+	}
+	if len(args.WsUserAgent) > 0 {
+		header.Set("User-Agent", args.WsUserAgent)
+	}
+	if len(args.WsOrigin) > 0 {
+		header.Set("Origin", args.WsOrigin)
+	}
+
+	secret := args.Secret
+	if len(s.Secret) > 0 {
+		secret = s.Secret
+	}
+	if len(secret) > 0 {
+		header.Set(AuthToken, secret)
+	}
+	return header, nil
+}
+
+// ParseWsRoute parses [host][/path][,secret=TOKEN][,dns=SERVER][,prefer=SPEC],
+// the path of the server url is taken when none is given. A route takes
+// --secret unless given its own, secret=none opens it to anyone. dns and
+// prefer may be repeated and give the route a resolver of its own.
+func ParseWsRoute(spec, defaultPath string) (*WsRoute, error) {
+	fields := strings.Split(spec, ",")
+	route := &WsRoute{Pattern: strings.TrimSpace(fields[0]), Secret: args.Secret}
+
+	host, path, found := strings.Cut(route.Pattern, "/")
+	if !found {
+		path = strings.TrimPrefix(defaultPath, "/")
+	}
+	if len(host) == 0 && len(path) == 0 && len(defaultPath) == 0 {
+		return nil, fmt.Errorf("route %s has neither host nor path", spec)
+	}
+	route.Pattern = host + "/" + path
+
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return nil, fmt.Errorf("route %s option %s has no value", route.Pattern, field)
+		}
+		switch key {
+		case "secret":
+			route.Secret = value
+			if value == "none" {
+				route.Secret = ""
+			}
+		case "dns":
+			route.DnsServer = append(route.DnsServer, value)
+		case "prefer":
+			route.DnsPrefer = append(route.DnsPrefer, value)
+		default:
+			return nil, fmt.Errorf("route %s: unknown option %s", route.Pattern, key)
+		}
+	}
+	return route, nil
+}
+
+// WsRoute is a configuration of the server chosen by the Host and path of
+// the WebSocket request.
+type WsRoute struct {
+	Pattern   string
+	Secret    string
+	DnsServer []string
+	DnsPrefer []string
+	dialer    *TargetDialer
+}
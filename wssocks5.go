@@ -3,20 +3,33 @@ package main
 import (
 	"context"
 	"io"
+	"net"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type WsSocks5Proxy struct {
 	Dispatcher
 	ctx    context.Context
 	cancel context.CancelFunc
+	dialer *TargetDialer
+	user   string
+	// who may ask the server to listen
+	reverseAcls []*ReverseAcl
+	// nil when the server has no agent listener
+	agents *Agents
 }
 
-func NewWsSocks5Proxy(ctx context.Context, d Dispatcher) *WsSocks5Proxy {
+func NewWsSocks5Proxy(ctx context.Context, d Dispatcher, dialer *TargetDialer, user string, reverseAcls []*ReverseAcl, agents *Agents) *WsSocks5Proxy {
 	ctx, cancel := context.WithCancel(ctx)
 	return &WsSocks5Proxy{
-		Dispatcher: d,
-		ctx:        ctx,
-		cancel:     cancel,
+		Dispatcher:  d,
+		ctx:         ctx,
+		cancel:      cancel,
+		dialer:      dialer,
+		user:        user,
+		reverseAcls: reverseAcls,
+		agents:      agents,
 	}
 }
 
@@ -35,8 +48,9 @@ func (w *WsSocks5Proxy) Close() error {
 	return w.Dispatcher.Close()
 }
 
-func (w *WsSocks5Proxy) accept(tunnel Tunnel) {
-	target, err := w.handshake(tunnel)
+func (w *WsSocks5Proxy) accept(t Tunnel) {
+	tunnel := NewBufferedConn(t)
+	target, err := w.handshake(tunnel, t.Id())
 	if err != nil {
 		if target != nil {
 			target.Close()
@@ -49,6 +63,19 @@ func (w *WsSocks5Proxy) accept(tunnel Tunnel) {
 	proxyConnection.TunnelTraffic()
 }
 
-func (w *WsSocks5Proxy) handshake(tunnel Tunnel) (io.ReadWriteCloser, error) {
-	return ServerHandshake(tunnel)
+func (w *WsSocks5Proxy) handshake(tunnel *BufferedConn, id uint16) (io.ReadWriteCloser, error) {
+	logger := log.WithFields(log.Fields{"tunnel": id, "user": w.user})
+	dial := func(ctx context.Context, network string, req *Request) (net.Conn, error) {
+		switch req.CmdOrRep {
+		case REVERSE:
+			return w.reverseListen(req, logger)
+		case AGENT:
+			if w.agents == nil {
+				return nil, errRejected
+			}
+			return w.agents.register(w, req, logger)
+		}
+		return w.dialer.Dial(ctx, network, req, w.user, logger)
+	}
+	return ServerHandshake(w.ctx, tunnel, dial)
 }